@@ -0,0 +1,114 @@
+package ntrip
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// ParseBasicAuth parses the value of an Authorization header using the Basic scheme, tolerating
+// extra whitespace and ignoring any parameters following the credentials
+func ParseBasicAuth(header string) (username, password string, ok bool) {
+	credentials, ok := authParams(header, "Basic")
+	if !ok {
+		return "", "", false
+	}
+
+	// Some clients append parameters such as charset after the credentials
+	if end := strings.IndexAny(credentials, " \t,"); end != -1 {
+		credentials = credentials[:end]
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ParseBearerAuth parses the value of an Authorization header using the Bearer scheme
+func ParseBearerAuth(header string) (token string, ok bool) {
+	token, ok = authParams(header, "Bearer")
+	if !ok || strings.ContainsAny(token, " \t") {
+		return "", false
+	}
+	return token, true
+}
+
+// ParseDigestAuth parses the value of an Authorization header using the Digest scheme into a map
+// of its parameters (such as username, realm, nonce, uri and response) - parameter names are
+// lower cased and quoted values are unquoted, verifying the response is left to the caller
+func ParseDigestAuth(header string) (params map[string]string, ok bool) {
+	rest, ok := authParams(header, "Digest")
+	if !ok {
+		return nil, false
+	}
+
+	params = map[string]string{}
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 1 {
+			return nil, false
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i == len(rest) {
+				// Unterminated quoted value
+				return nil, false
+			}
+			value, rest = b.String(), rest[i+1:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		params[key] = value
+
+		rest = strings.TrimSpace(rest)
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, false
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+
+	if len(params) == 0 {
+		return nil, false
+	}
+	return params, true
+}
+
+// Returns the part of an Authorization header following the given scheme, which is matched case
+// insensitively and must be followed by whitespace
+func authParams(header, scheme string) (string, bool) {
+	header = strings.TrimSpace(header)
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return "", false
+	}
+
+	rest := header[len(scheme):]
+	if rest[0] != ' ' && rest[0] != '\t' {
+		return "", false
+	}
+
+	rest = strings.TrimSpace(rest)
+	return rest, rest != ""
+}
@@ -0,0 +1,88 @@
+package ntrip_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-gnss/ntrip"
+)
+
+func TestParseBasicAuth(t *testing.T) {
+	// dXNlcm5hbWU6cGFzc3dvcmQ= is "username:password"
+	cases := []struct {
+		Header             string
+		Username, Password string
+		OK                 bool
+	}{
+		{"Basic dXNlcm5hbWU6cGFzc3dvcmQ=", "username", "password", true},
+		{"basic dXNlcm5hbWU6cGFzc3dvcmQ=", "username", "password", true},
+		{"Basic  dXNlcm5hbWU6cGFzc3dvcmQ=", "username", "password", true},
+		{" Basic\tdXNlcm5hbWU6cGFzc3dvcmQ= ", "username", "password", true},
+		{`Basic dXNlcm5hbWU6cGFzc3dvcmQ=, charset="UTF-8"`, "username", "password", true},
+		// "username:" has an empty password
+		{"Basic dXNlcm5hbWU6", "username", "", true},
+		{"Basic not-base64!", "", "", false},
+		// "username" has no colon
+		{"Basic dXNlcm5hbWU=", "", "", false},
+		{"BasicdXNlcm5hbWU6cGFzc3dvcmQ=", "", "", false},
+		{"Basic ", "", "", false},
+		{"Bearer token", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tc := range cases {
+		username, password, ok := ntrip.ParseBasicAuth(tc.Header)
+		if username != tc.Username || password != tc.Password || ok != tc.OK {
+			t.Errorf("parsing %q: expected (%q, %q, %t), received (%q, %q, %t)",
+				tc.Header, tc.Username, tc.Password, tc.OK, username, password, ok)
+		}
+	}
+}
+
+func TestParseBearerAuth(t *testing.T) {
+	cases := []struct {
+		Header string
+		Token  string
+		OK     bool
+	}{
+		{"Bearer abc.def-ghi", "abc.def-ghi", true},
+		{"bearer   abc ", "abc", true},
+		{"Bearer abc def", "", false},
+		{"Bearer", "", false},
+		{"Basic dXNlcm5hbWU6cGFzc3dvcmQ=", "", false},
+	}
+
+	for _, tc := range cases {
+		token, ok := ntrip.ParseBearerAuth(tc.Header)
+		if token != tc.Token || ok != tc.OK {
+			t.Errorf("parsing %q: expected (%q, %t), received (%q, %t)", tc.Header, tc.Token, tc.OK, token, ok)
+		}
+	}
+}
+
+func TestParseDigestAuth(t *testing.T) {
+	cases := []struct {
+		Header string
+		Params map[string]string
+		OK     bool
+	}{
+		{
+			`Digest username="user", realm="caster, AUS", nonce="abc", uri="/MOUNT", qop=auth, nc=00000001, response="def"`,
+			map[string]string{"username": "user", "realm": "caster, AUS", "nonce": "abc", "uri": "/MOUNT", "qop": "auth", "nc": "00000001", "response": "def"},
+			true,
+		},
+		{`digest  Username = "us\"er" ,realm="r"`, map[string]string{"username": `us"er`, "realm": "r"}, true},
+		{`Digest username="unterminated`, nil, false},
+		{`Digest username="user" realm="r"`, nil, false},
+		{`Digest =value`, nil, false},
+		{`Digest`, nil, false},
+		{`Basic dXNlcm5hbWU6cGFzc3dvcmQ=`, nil, false},
+	}
+
+	for _, tc := range cases {
+		params, ok := ntrip.ParseDigestAuth(tc.Header)
+		if !reflect.DeepEqual(params, tc.Params) || ok != tc.OK {
+			t.Errorf("parsing %q: expected (%v, %t), received (%v, %t)", tc.Header, tc.Params, tc.OK, params, ok)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package ntrip
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BitratePolicy decides what the Caster does when a publisher exceeds MaxPublishBitrate
+type BitratePolicy int
+
+const (
+	// LogBitrate logs a warning and continues accepting data from the publisher
+	LogBitrate BitratePolicy = iota
+	// DisconnectPublisher logs a warning and closes the publisher's connection
+	DisconnectPublisher
+)
+
+// bitrateSample is the number of bytes returned by a single Read
+type bitrateSample struct {
+	time  time.Time
+	bytes int64
+}
+
+// bitrateReader wraps a publisher's request body, logging a warning when more data than the limit
+// allows has been read within the sliding window, and optionally returning an error to close the
+// connection - this stops a misconfigured base station from flooding the Caster and subscribers
+type bitrateReader struct {
+	io.Reader
+	limit      int64
+	window     time.Duration
+	disconnect bool
+	logger     logrus.FieldLogger
+
+	samples  []bitrateSample
+	total    int64
+	exceeded bool
+}
+
+func newBitrateReader(r io.Reader, limit int64, window time.Duration, policy BitratePolicy, logger logrus.FieldLogger) *bitrateReader {
+	return &bitrateReader{
+		Reader:     r,
+		limit:      limit,
+		window:     window,
+		disconnect: policy == DisconnectPublisher,
+		logger:     logger,
+	}
+}
+
+func (b *bitrateReader) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	now := time.Now()
+	b.samples = append(b.samples, bitrateSample{now, int64(n)})
+	b.total += int64(n)
+
+	// Drop samples which have left the window
+	i := 0
+	for ; i < len(b.samples) && now.Sub(b.samples[i].time) > b.window; i++ {
+		b.total -= b.samples[i].bytes
+	}
+	b.samples = b.samples[i:]
+
+	bitrate := int64(float64(b.total*8) / b.window.Seconds())
+	if bitrate <= b.limit {
+		if b.exceeded {
+			b.exceeded = false
+			b.logger.Infof("publisher bitrate back under maximum of %d bps", b.limit)
+		}
+		return n, err
+	}
+
+	if !b.exceeded {
+		b.exceeded = true
+		b.logger.Warnf("publisher bitrate of %d bps exceeds maximum of %d bps", bitrate, b.limit)
+	}
+	if b.disconnect {
+		return n, fmt.Errorf("publisher exceeded maximum bitrate of %d bps", b.limit)
+	}
+	return n, err
+}
@@ -1,10 +1,15 @@
 package ntrip
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -16,16 +21,101 @@ type SourceService interface {
 	GetSourcetable() Sourcetable
 	// TODO: Specifying username and password may be limiting, could instead take the content of
 	//  the auth header
-	// TODO: A SourceService implementation can't support nearest base functionality because it
-	//  wouldn't have access to NMEA headers - in general, it may be arbitrarily limiting to not
-	//  pass the http.Request object (leaving it up to the implementation to parse headers etc.)
+	// TODO: It may be arbitrarily limiting to not pass the http.Request object (leaving it up to
+	//  the implementation to parse headers etc.), GGASubscriber is used to pass client positions
+	//  for nearest base functionality
 	Publisher(ctx context.Context, mount, username, password string) (io.WriteCloser, error)
 	Subscriber(ctx context.Context, mount, username, password string) (chan []byte, error)
 }
 
-// Caster wraps http.Server, it provides nothing but timeouts and the Handler
+// GGASubscriber can optionally be implemented by a SourceService to support VRS and nearest base
+// mounts, if implemented it's used by the Caster instead of Subscriber
+type GGASubscriber interface {
+	// SubscriberWithGGA is the same as Subscriber, but also receives the positions sent by the
+	// client as GGA sentences, in the Ntrip-GGA header and while connected (in the request body
+	// for NTRIP v2) - the gga channel is closed when the client stops sending data
+	SubscriberWithGGA(ctx context.Context, mount, username, password string, gga <-chan GGA) (chan []byte, error)
+}
+
+// SourceManager can optionally be implemented by a SourceService to allow operators to forcibly
+// close connections, for example in response to abuse
+type SourceManager interface {
+	// Disconnect closes the publisher and all subscribers of a mount
+	Disconnect(mount string) error
+	// DisconnectUser closes all publishers and subscribers connected with the given username
+	DisconnectUser(username string) error
+}
+
+// Caster wraps http.Server, it provides timeouts and the Handler, which can be configured by
+// setting the Caster's fields before calling ListenAndServe()
 type Caster struct {
 	http.Server
+
+	// PublisherGapTimeout is the period without data from a connected publisher after which a
+	// warning is logged and GapPolicy decides whether the publisher is disconnected, recovery is
+	// logged when data resumes - zero disables gap detection
+	PublisherGapTimeout time.Duration
+	// MountGapTimeouts overrides PublisherGapTimeout for specific mounts, since streams have
+	// different expected data rates - it must not be modified once the Caster is serving
+	MountGapTimeouts map[string]time.Duration
+	GapPolicy        GapPolicy
+
+	// MaxPublishBitrate is the maximum rate in bits per second a publisher may send, averaged over
+	// PublishBitrateWindow (NewCaster sets this to 10 seconds) - when exceeded a warning is logged
+	// and BitratePolicy decides whether the publisher is disconnected, zero disables the limit
+	MaxPublishBitrate    int64
+	PublishBitrateWindow time.Duration
+	BitratePolicy        BitratePolicy
+
+	// SubscriberWriteTimeout is the time allowed for each write to a subscriber's connection, after
+	// which the subscriber is disconnected - NewCaster sets this to 10 seconds, zero disables the
+	// deadline for links which legitimately stall, leaving dead connections to TCP keepalive. The
+	// deadline is set using the connection stored by the Server's ConnContext, which NewCaster sets
+	// and shouldn't be replaced.
+	SubscriberWriteTimeout time.Duration
+
+	// Registry keeps track of accepted publisher and subscriber connections, NewCaster sets this
+	// to a MemoryRegistry - nil disables connection tracking
+	Registry ConnectionRegistry
+
+	// QueryCredentials allows clients which can't set an Authorization header to authenticate
+	// using the user and pass query parameters, for example "/MOUNT?user=name&pass=secret" - this
+	// is disabled by default because URLs are commonly logged
+	QueryCredentials bool
+
+	// Realm is used in the WWW-Authenticate challenge for all mounts, if empty the request path
+	// is used as the realm
+	Realm string
+
+	// ChallengeNotFound responds to requests for unknown mounts with 401 and an authentication
+	// challenge rather than 404, so clients can't find out which mounts exist without credentials
+	ChallengeNotFound bool
+
+	// OnConnect and OnDisconnect are called, if set, when a publisher or subscriber connection is
+	// accepted and when it's closed - they're called from the request's goroutine, so should not
+	// block
+	OnConnect    func(conn Connection)
+	OnDisconnect func(conn Connection)
+
+	// MaxConnectionsPerIP limits the number of concurrent requests from a single source IP, further
+	// requests receive 429 Too Many Requests - zero disables the limit
+	MaxConnectionsPerIP int
+	ipConnections       map[string]int
+	ipLock              sync.Mutex
+
+	// TrustedProxies are the networks of load balancers which send a PROXY protocol header at the
+	// start of each connection, ListenAndServe and ListenAndServeTLS use the client address from
+	// the header for connections from these networks - so logging and MaxConnectionsPerIP see the
+	// real client. Use NewProxyProtocolListener when calling Serve directly.
+	TrustedProxies []*net.IPNet
+
+	// metrics are served by MetricsHandler
+	metrics *metrics
+
+	// shutdown is closed when Shutdown is called, which disconnects subscribers so Shutdown doesn't
+	// wait for them to close their connections
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
 // NewCaster constructs a Caster, setting up the Handler and timeouts - run using ListenAndServe()
@@ -34,25 +124,162 @@ type Caster struct {
 //  or a /stats endpoint - Though those could instead be run on separate http.Server's
 //  Also, middleware can be added to a Caster by doing `c.Handler = someMiddleware(c.Handler)`
 func NewCaster(addr string, svc SourceService, logger logrus.FieldLogger) *Caster {
-	return &Caster{
-		http.Server{
+	c := &Caster{
+		Server: http.Server{
 			Addr:        addr,
-			Handler:     getHandler(svc, logger),
 			IdleTimeout: 10 * time.Second,
+			// Unlike ReadTimeout, this only applies until the request headers are read, so
+			// protects against slow header (slowloris) clients without affecting publishers
+			ReadHeaderTimeout: 10 * time.Second,
 			// Read timeout kills publishing connections because they don't necessarily read from
 			// the response body
 			//ReadTimeout: 10 * time.Second,
 			// Write timeout kills subscriber connections because they don't write to the request
-			// body
+			// body, SubscriberWriteTimeout is used instead
 			//WriteTimeout: 10 * time.Second,
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				return context.WithValue(ctx, connContextKey, conn)
+			},
 		},
+		SubscriberWriteTimeout: 10 * time.Second,
+		PublishBitrateWindow:   10 * time.Second,
+		Registry:               NewMemoryRegistry(),
+		metrics:                newMetrics(),
+		shutdown:               make(chan struct{}),
+	}
+	c.Handler = getHandler(c, svc, logger)
+	// Covers the embedded Server's Shutdown being called directly, which runs this asynchronously
+	c.RegisterOnShutdown(c.closeShutdown)
+	return c
+}
+
+// Shutdown disconnects subscribers before calling http.Server's Shutdown, which waits for
+// connections to close
+func (c *Caster) Shutdown(ctx context.Context) error {
+	c.closeShutdown()
+	return c.Server.Shutdown(ctx)
+}
+
+func (c *Caster) closeShutdown() {
+	c.shutdownOnce.Do(func() { close(c.shutdown) })
+}
+
+// ListenAndServe validates the Caster's Addr before calling http.Server's ListenAndServe, so a
+// malformed address such as "2101" returns a clear error
+func (c *Caster) ListenAndServe() error {
+	if err := validateAddr(c.Addr); err != nil {
+		return err
+	}
+	if len(c.TrustedProxies) == 0 {
+		return c.Server.ListenAndServe()
+	}
+
+	l, err := c.listenProxyProtocol(":http")
+	if err != nil {
+		return err
+	}
+	return c.Serve(l)
+}
+
+// ListenAndServeTLS validates the Caster's Addr before calling http.Server's ListenAndServeTLS,
+// certFile and keyFile can be empty if TLSConfig provides certificates, such as when using a
+// CertificateReloader
+func (c *Caster) ListenAndServeTLS(certFile, keyFile string) error {
+	if err := validateAddr(c.Addr); err != nil {
+		return err
+	}
+	if len(c.TrustedProxies) == 0 {
+		return c.Server.ListenAndServeTLS(certFile, keyFile)
 	}
+
+	l, err := c.listenProxyProtocol(":https")
+	if err != nil {
+		return err
+	}
+	return c.ServeTLS(l, certFile, keyFile)
+}
+
+// Listens on the Caster's Addr, or defaultAddr if it's empty, expecting PROXY protocol headers
+// from TrustedProxies - the header must be received within ReadHeaderTimeout. Returns
+// http.ErrServerClosed once Shutdown has been called, as http.Server's ListenAndServe does.
+func (c *Caster) listenProxyProtocol(defaultAddr string) (net.Listener, error) {
+	select {
+	case <-c.shutdown:
+		return nil, http.ErrServerClosed
+	default:
+	}
+
+	addr := c.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewProxyProtocolListener(l, c.TrustedProxies, c.ReadHeaderTimeout), nil
+}
+
+// Holds the net.Conn a request was received on, set by the Server's ConnContext
+var connContextKey = contextKey("Conn")
+
+// Checks addr is a valid host:port, an empty addr is allowed because http.Server defaults it
+func validateAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+
+	if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		return fmt.Errorf("invalid caster address %q: %s", addr, err)
+	}
+	return nil
+}
+
+// Counts a request from remoteAddr against MaxConnectionsPerIP, returning false if the limit has
+// been reached or otherwise a function which must be called once the request is finished
+func (c *Caster) acquireIP(remoteAddr string) (release func(), ok bool) {
+	if c.MaxConnectionsPerIP <= 0 {
+		return func() {}, true
+	}
+
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	c.ipLock.Lock()
+	defer c.ipLock.Unlock()
+
+	if c.ipConnections == nil {
+		c.ipConnections = map[string]int{}
+	}
+	if c.ipConnections[ip] >= c.MaxConnectionsPerIP {
+		return nil, false
+	}
+	c.ipConnections[ip]++
+
+	return func() {
+		c.ipLock.Lock()
+		defer c.ipLock.Unlock()
+		if c.ipConnections[ip]--; c.ipConnections[ip] == 0 {
+			delete(c.ipConnections, ip)
+		}
+	}, true
+}
+
+// Returns the publisher gap timeout for mount
+func (c *Caster) gapTimeout(mount string) time.Duration {
+	if timeout, ok := c.MountGapTimeouts[mount]; ok {
+		return timeout
+	}
+	return c.PublisherGapTimeout
 }
 
 // Wraps handler in a http.Handler - this is done instead of making handler implement the
 // http.Handler interface so that a new handler can be constructed for each request
 // TODO: See TODO on handler type about changing the name
-func getHandler(svc SourceService, logger logrus.FieldLogger) http.Handler {
+func getHandler(c *Caster, svc SourceService, logger logrus.FieldLogger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		requestVersion := 1
 		if strings.ToUpper(r.Header.Get(NTRIPVersionHeaderKey)) == strings.ToUpper(NTRIPVersionHeaderValueV2) {
@@ -61,8 +288,9 @@ func getHandler(svc SourceService, logger logrus.FieldLogger) http.Handler {
 
 		requestID := uuid.New().String()
 		ctx := context.WithValue(r.Context(), RequestIDContextKey, requestID)
+		ctx = context.WithValue(ctx, RemoteAddrContextKey, r.RemoteAddr)
 
-		username, _, _ := r.BasicAuth()
+		username, _, fromQuery := credentials(c, r)
 
 		l := logger.WithFields(logrus.Fields{
 			"request_id":      requestID,
@@ -74,7 +302,92 @@ func getHandler(svc SourceService, logger logrus.FieldLogger) http.Handler {
 			"user_agent":      r.UserAgent(),
 		})
 
-		h := &handler{svc, l}
+		if fromQuery {
+			l.Warn("using credentials from query string, which may be exposed in proxy and access logs")
+		}
+
+		// Recover from panics in the handler or SourceService so they are logged with the request's
+		// fields, rather than being printed by http.Server without any context
+		rw := &responseWriter{ResponseWriter: w}
+		w = rw.wrap()
+		defer func() {
+			if p := recover(); p != nil {
+				// http.ErrAbortHandler aborts the response, and is expected to reach http.Server
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+
+				l.WithField("stack", string(debug.Stack())).Errorf("recovered from panic: %v", p)
+				// A status can't be sent once the response has started or the connection is hijacked
+				if !rw.written {
+					http.Error(rw.ResponseWriter, "", http.StatusInternalServerError)
+				}
+			}
+		}()
+
+		release, ok := c.acquireIP(r.RemoteAddr)
+		if !ok {
+			l.Warnf("rejecting request, source IP has %d connections", c.MaxConnectionsPerIP)
+			c.metrics.refused(ErrorTooManyConnections)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		h := &handler{svc, l, c}
 		h.handleRequest(w, r.WithContext(ctx))
 	})
 }
+
+// responseWriter records whether a response has been started, so getHandler knows whether it can
+// still respond to a panic
+type responseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+// Returns rw as a http.ResponseWriter which implements http.Flusher and http.Hijacker only if the
+// wrapped ResponseWriter does, since the handler checks for them
+func (rw *responseWriter) wrap() http.ResponseWriter {
+	_, flusher := rw.ResponseWriter.(http.Flusher)
+	_, hijacker := rw.ResponseWriter.(http.Hijacker)
+	switch {
+	case flusher && hijacker:
+		return rw
+	case flusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{rw, rw}
+	case hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{rw, rw}
+	default:
+		return struct{ http.ResponseWriter }{rw}
+	}
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	rw.written = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	rw.written = true
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *responseWriter) Flush() {
+	rw.written = true
+	rw.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := rw.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		rw.written = true
+	}
+	return conn, brw, err
+}
@@ -1,9 +1,15 @@
 package ntrip_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,6 +24,14 @@ import (
 //  caster.ListenAndServe(), write data with v2 server and read with v2 and v1 clients
 func TestCasterServerClient(t *testing.T) {
 	caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), logrus.StandardLogger())
+	// The v1 and v2 clients share the mock's data channel, so the v1 client must only connect
+	// once the v2 client's handler has returned
+	subscriberClosed := make(chan struct{}, 1)
+	caster.OnDisconnect = func(conn ntrip.Connection) {
+		if conn.Role == ntrip.RoleSubscriber {
+			subscriberClosed <- struct{}{}
+		}
+	}
 	ts := httptest.NewServer(caster.Handler)
 	defer ts.Close()
 
@@ -40,11 +54,11 @@ func TestCasterServerClient(t *testing.T) {
 
 	testV2Client(t, ts.URL+mock.MountPath, w)
 
-	// POST request's context may not get closed in the server before the next Write occurs,
-	// resulting in the mock writing to the first connected client's Body
-	// Nothing like a 10ms timeout to fix a bit of non-deterministic behaviour
-	// TODO: Could fix this by rewriting the mock service, or using the inmemory SourceService
-	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-subscriberClosed:
+	case <-time.After(time.Second):
+		t.Fatalf("v2 client - timed out waiting for subscriber to disconnect")
+	}
 
 	testV1Client(t, ts.URL[7:], mock.MountPath, w)
 }
@@ -116,3 +130,244 @@ func testV2Client(t *testing.T, url string, serverWriter io.Writer) {
 
 	resp.Body.Close()
 }
+
+// v2 GET responses aren't hijacked, so the http.Server writes data with chunked transfer encoding
+// which can be read by standard HTTP clients
+func TestV2ChunkedResponse(t *testing.T) {
+	ms := mock.NewMockSourceService()
+	ms.DataChannel = make(chan []byte, 2)
+	ms.DataChannel <- []byte("first chunk ")
+	ms.DataChannel <- []byte("second chunk")
+	close(ms.DataChannel)
+
+	ts := httptest.NewServer(ntrip.NewCaster("N/A", ms, logrus.StandardLogger()).Handler)
+	defer ts.Close()
+
+	req, _ := ntrip.NewClientRequest(ts.URL + mock.MountPath)
+	req.SetBasicAuth(mock.Username, mock.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error connecting to caster: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("expected chunked transfer encoding, received %v", resp.TransferEncoding)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading chunked response body: %s", err)
+	}
+
+	if string(body) != "first chunk second chunk" {
+		t.Errorf("expected response body %q, received %q", "first chunk second chunk", string(body))
+	}
+}
+
+func TestCasterAddrValidation(t *testing.T) {
+	cases := []struct {
+		Addr  string
+		Valid bool
+	}{
+		{"127.0.0.1:0", true},
+		{":0", true},
+		{"localhost:0", true},
+		{"2101", false},
+		{"localhost", false},
+		{"127.0.0.1:99999", false},
+		{"127.0.0.1:notaport", false},
+	}
+
+	for _, tc := range cases {
+		caster := ntrip.NewCaster(tc.Addr, mock.NewMockSourceService(), logrus.StandardLogger())
+
+		errs := make(chan error, 1)
+		go func() { errs <- caster.ListenAndServe() }()
+		// Valid addresses start serving until closed, whether Close is called before or after
+		// the listener starts ListenAndServe returns http.ErrServerClosed
+		caster.Close()
+
+		err := <-errs
+		if tc.Valid && err != http.ErrServerClosed {
+			t.Errorf("expected address %q to be valid, received error: %v", tc.Addr, err)
+		} else if !tc.Valid && (err == nil || !strings.HasPrefix(err.Error(), "invalid caster address")) {
+			t.Errorf("expected address %q to be invalid, received error: %v", tc.Addr, err)
+		}
+	}
+}
+
+// Caster uses net/http's listener, so IPv6 and dual-stack addresses such as "[::]:2101" work as
+// they do for any http.Server
+func TestCasterIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %s", err)
+	}
+
+	caster := ntrip.NewCaster(ln.Addr().String(), mock.NewMockSourceService(), logrus.StandardLogger())
+	go caster.Serve(ln)
+	defer caster.Close()
+
+	req, _ := ntrip.NewClientRequest("http://" + ln.Addr().String())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error connecting to caster over IPv6: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected response code %d, received %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func ExampleNewCaster_jsonLogging() {
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	caster := ntrip.NewCaster(":2101", mock.NewMockSourceService(), logger)
+	caster.ListenAndServe()
+}
+
+func TestCasterJSONLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetOutput(buf)
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	ntrip.NewCaster("N/A", mock.NewMockSourceService(), logger).Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	for _, line := range lines {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("log line is not valid JSON: %s", line)
+		}
+		if entry["request_id"] == nil || entry["msg"] == nil {
+			t.Errorf("expected request_id and msg fields in log line: %s", line)
+		}
+	}
+}
+
+func TestCasterShutdownDisconnectsSubscribers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	ms := mock.NewMockSourceService()
+	ms.DataChannel = make(chan []byte, 1)
+	ms.DataChannel <- []byte("data")
+
+	caster := ntrip.NewCaster(ln.Addr().String(), ms, logrus.StandardLogger())
+	go caster.Serve(ln)
+
+	req, _ := ntrip.NewClientRequest("http://" + ln.Addr().String() + mock.MountPath)
+	req.SetBasicAuth(mock.Username, mock.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error connecting subscriber: %s", err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("error reading data: %s", err)
+	}
+
+	// The subscriber stays connected, so Shutdown would time out if it wasn't disconnected
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := caster.Shutdown(ctx); err != nil {
+		t.Fatalf("error shutting down caster: %s", err)
+	}
+
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Errorf("expected subscriber response to end cleanly, received error: %s", err)
+	}
+}
+
+func TestCasterShutdownDisconnectsGGASubscribers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	ms := mock.NewMockSourceService()
+	ms.DataChannel = make(chan []byte, 1)
+	ms.DataChannel <- []byte("data")
+
+	caster := ntrip.NewCaster(ln.Addr().String(), ms, logrus.StandardLogger())
+	go caster.Serve(ln)
+
+	// VRS clients keep their request body open to send GGA sentences
+	r, w := io.Pipe()
+	defer w.Close()
+	req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+mock.MountPath, r)
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error connecting subscriber: %s", err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("error reading data: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := caster.Shutdown(ctx); err != nil {
+		t.Fatalf("error shutting down caster: %s", err)
+	}
+}
+
+func TestCasterListenAfterShutdown(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	for _, proxies := range [][]*net.IPNet{nil, {trusted}} {
+		caster := ntrip.NewCaster("127.0.0.1:0", mock.NewMockSourceService(), logrus.StandardLogger())
+		caster.TrustedProxies = proxies
+		if err := caster.Shutdown(context.Background()); err != nil {
+			t.Fatalf("error shutting down caster: %s", err)
+		}
+
+		if err := caster.ListenAndServe(); err != http.ErrServerClosed {
+			t.Errorf("trusted proxies %v: expected ListenAndServe error %q, received %v", proxies, http.ErrServerClosed, err)
+		}
+		if err := caster.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			t.Errorf("trusted proxies %v: expected ListenAndServeTLS error %q, received %v", proxies, http.ErrServerClosed, err)
+		}
+	}
+}
+
+func TestCasterReadHeaderTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	caster := ntrip.NewCaster(ln.Addr().String(), mock.NewMockSourceService(), logrus.StandardLogger())
+	caster.ReadHeaderTimeout = 100 * time.Millisecond
+	go caster.Serve(ln)
+	defer caster.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to caster: %s", err)
+	}
+	defer conn.Close()
+
+	// Send part of the headers and then stall
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: caster\r\n")); err != nil {
+		t.Fatalf("error writing request: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("expected caster to close slow header connection, received error: %s", err)
+	}
+}
@@ -0,0 +1,100 @@
+package ntrip
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateReloader loads a TLS certificate and key from disk, reloading them when either file
+// changes so renewed certificates (such as from Let's Encrypt) are used without restarting the
+// Caster - set GetCertificate as the Caster's TLSConfig.GetCertificate and call
+// ListenAndServeTLS with empty file names:
+//
+//	reloader, err := ntrip.NewCertificateReloader("cert.pem", "key.pem")
+//	caster.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+//	caster.ListenAndServeTLS("", "")
+type CertificateReloader struct {
+	certFile, keyFile string
+	// CheckInterval is the minimum time between checking the files for changes, which is done
+	// during TLS handshakes - NewCertificateReloader sets this to one minute
+	CheckInterval time.Duration
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+// NewCertificateReloader constructs a CertificateReloader, returning an error if the certificate
+// and key can't be loaded
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	cr := &CertificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		CheckInterval: 1 * time.Minute,
+	}
+	return cr, cr.Reload()
+}
+
+// Reload loads the certificate and key from disk, the previous certificate continues to be used
+// if an error is returned
+func (cr *CertificateReloader) Reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.reload()
+}
+
+// GetCertificate returns the current certificate, first reloading it if CheckInterval has passed
+// and the files have changed - if reloading fails the previous certificate is returned, so a
+// partially written certificate doesn't stop the Caster from accepting connections
+func (cr *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.lastCheck) >= cr.CheckInterval {
+		cr.lastCheck = time.Now()
+		if cr.changed() {
+			_ = cr.reload()
+		}
+	}
+	return cr.cert, nil
+}
+
+// Returns true if either file's modification time differs from when they were last loaded - must
+// be called while holding the lock
+func (cr *CertificateReloader) changed() bool {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(cr.certModTime) || !keyInfo.ModTime().Equal(cr.keyModTime)
+}
+
+// Must be called while holding the lock
+func (cr *CertificateReloader) reload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.cert = &cert
+	cr.certModTime = certInfo.ModTime()
+	cr.keyModTime = keyInfo.ModTime()
+	return nil
+}
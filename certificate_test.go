@@ -0,0 +1,109 @@
+package ntrip_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/ntrip"
+	"github.com/go-gnss/ntrip/internal/mock"
+)
+
+// Writes a self-signed certificate with the given serial number and its key to dir
+func writeCertificate(t *testing.T, dir string, serial int64) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshalling key: %s", err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	// Ensure modification times differ from any previous certificate
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+	return certFile, keyFile
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ntrip-certs")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir, 1)
+	reloader, err := ntrip.NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %s", err)
+	}
+	reloader.CheckInterval = 0
+
+	caster := ntrip.NewCaster("", mock.NewMockSourceService(), logger)
+	caster.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	go caster.ServeTLS(ln, "", "")
+	defer caster.Close()
+
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("error connecting to caster: %s", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if s := serial(); s != 1 {
+		t.Errorf("expected certificate serial 1, received %d", s)
+	}
+
+	writeCertificate(t, dir, 2)
+	if s := serial(); s != 2 {
+		t.Errorf("expected certificate serial 2 after replacing files, received %d", s)
+	}
+
+	// An invalid certificate is ignored in favour of the previous one
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+	modTime := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, modTime, modTime)
+	if s := serial(); s != 2 {
+		t.Errorf("expected certificate serial 2 after invalid replacement, received %d", s)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("expected error reloading invalid certificate")
+	}
+}
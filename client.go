@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // NewClientRequest constructs an http.Request which can be used as an NTRIP v2 Client
@@ -28,6 +29,67 @@ func NewServerRequest(url string, r io.ReadCloser) (*http.Request, error) {
 	return req, err
 }
 
+// keepaliveBytes are sent by a KeepaliveReader during gaps in data, a line ending is ignored by
+// RTCM decoders which scan for a frame preamble
+var keepaliveBytes = []byte("\r\n")
+
+// KeepaliveReader wraps a Server's data source, returned by NewKeepaliveReader
+type KeepaliveReader struct {
+	*io.PipeReader
+	r        io.ReadCloser
+	pw       *io.PipeWriter
+	interval time.Duration
+	timer    *time.Timer
+}
+
+// NewKeepaliveReader wraps r so that a line ending is read whenever r has produced no data for
+// the given interval, for use as the body of a NewServerRequest - this stops NAT devices and
+// proxies between a Server and the Caster from dropping the connection during gaps in data.
+//
+// Keepalive bytes count as data to the Caster, so an interval shorter than the Caster's
+// PublisherGapTimeout will suppress its gap warnings.
+func NewKeepaliveReader(r io.ReadCloser, interval time.Duration) *KeepaliveReader {
+	pr, pw := io.Pipe()
+	k := &KeepaliveReader{PipeReader: pr, r: r, pw: pw, interval: interval}
+	k.timer = time.AfterFunc(time.Hour, k.keepalive)
+	k.timer.Reset(interval)
+	go k.copy()
+	return k
+}
+
+// Close closes both the underlying reader and the pipe data is read from
+func (k *KeepaliveReader) Close() error {
+	k.timer.Stop()
+	k.PipeReader.Close()
+	return k.r.Close()
+}
+
+func (k *KeepaliveReader) copy() {
+	defer k.timer.Stop()
+	buf := make([]byte, 4096)
+	for {
+		n, err := k.r.Read(buf)
+		if n > 0 {
+			k.timer.Reset(k.interval)
+			if _, err := k.pw.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			k.pw.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// Called by timer when no data has been read for the interval
+func (k *KeepaliveReader) keepalive() {
+	// Writes to the pipe are serialized, so keepalive bytes can't split a write from copy
+	if _, err := k.pw.Write(keepaliveBytes); err == nil {
+		k.timer.Reset(k.interval)
+	}
+}
+
 // TODO: Remove v1 client
 func NewClientV1(host string, path, username, password string) (io.ReadCloser, error) {
 	conn, err := net.Dial("tcp", host)
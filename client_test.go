@@ -5,6 +5,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
 
 	"github.com/go-gnss/ntrip"
 )
@@ -59,3 +62,50 @@ func ExampleNewServerRequest() {
 	w.Write([]byte("write data to the NTRIP caster"))
 	w.Close()
 }
+
+func TestKeepaliveReader(t *testing.T) {
+	received := make(chan string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				received <- string(buf[:n])
+			}
+			if err != nil {
+				close(received)
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	r, w := io.Pipe()
+	req, _ := ntrip.NewServerRequest(ts.URL+"/mount", ntrip.NewKeepaliveReader(r, 50*time.Millisecond))
+	go http.DefaultClient.Do(req)
+
+	expect := func(want string) {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected %q, received %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	w.Write([]byte("data"))
+	expect("data")
+
+	// No data written by the publisher, so keepalives should be sent
+	expect("\r\n")
+	expect("\r\n")
+
+	w.Write([]byte("more data"))
+	expect("more data")
+
+	w.Close()
+	for range received {
+	}
+}
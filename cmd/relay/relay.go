@@ -2,18 +2,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
 	"time"
 
 	"github.com/go-gnss/ntrip"
-)
-
-var (
-	reader, writer = io.Pipe()
+	"github.com/go-gnss/ntrip/internal/backoff"
 )
 
 func main() {
@@ -23,15 +23,31 @@ func main() {
 	destination := flag.String("dest", "", "NTRIP caster URL to stream from")
 	destUsername := flag.String("duser", "", "Username for accessing the Destination NTRIP caster")
 	destPassword := flag.String("dpass", "", "Password for accessing the Destination NTRIP caster")
-	timeout := flag.Duration("timeout", 2, "NTRIP reconnect timeout")
+	timeout := flag.Duration("timeout", 5*time.Second, "Initial NTRIP reconnect timeout, doubled after each failure")
+	maxTimeout := flag.Duration("maxtimeout", 2*time.Minute, "Maximum NTRIP reconnect timeout")
 	flag.Parse()
 
-	go serve(*destination, *destUsername, *destPassword, *timeout)
+	// Stop reconnecting on interrupt
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	// serve sends the writer for each connection to the destination, data read from the source is
+	// written to the latest one
+	writers := make(chan *io.PipeWriter, 1)
+	go serve(ctx, *destination, *destUsername, *destPassword, backoff.New(*timeout, *maxTimeout), writers)
+	var writer *io.PipeWriter
 
 	// Write response body to PipeWriter
 	client, _ := ntrip.NewClientRequest(*source)
 	client.SetBasicAuth(*sourceUsername, *sourcePassword)
-	for ; ; time.Sleep(time.Second * *timeout) {
+	client = client.WithContext(ctx)
+	b := backoff.New(*timeout, *maxTimeout)
+	for ; ctx.Err() == nil; b.Wait(ctx) {
 		resp, err := http.DefaultClient.Do(client)
 		if err != nil || resp.StatusCode != 200 {
 			fmt.Println("client failed to connect", resp, err)
@@ -39,29 +55,48 @@ func main() {
 		}
 
 		fmt.Println("client connected")
+		b.Reset()
 		data := make([]byte, 4096)
 		br, err := resp.Body.Read(data)
 		for ; err == nil; br, err = resp.Body.Read(data) {
-			writer.Write(data[:br])
+			select {
+			case writer = <-writers:
+			default:
+			}
+			// Data is dropped while the destination is disconnected
+			if writer != nil {
+				writer.Write(data[:br])
+			}
 		}
 
 		fmt.Println("client connection died", err)
 	}
 }
 
-// Serve whatever is written to the PipeWriter
-func serve(url, username, password string, timeout time.Duration) {
-	for ; ; time.Sleep(time.Second * timeout) {
-		reader, writer = io.Pipe()
+// Serve whatever is written to the PipeWriters sent on writers, a new pipe is used for each
+// connection and closed once it ends so writes to it fail rather than block
+func serve(ctx context.Context, url, username, password string, b *backoff.Backoff, writers chan<- *io.PipeWriter) {
+	for ; ctx.Err() == nil; b.Wait(ctx) {
+		reader, writer := io.Pipe()
+		select {
+		case writers <- writer:
+		case <-ctx.Done():
+			return
+		}
+
 		req, _ := ntrip.NewServerRequest(url, reader)
 		req.SetBasicAuth(username, password)
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 		if err != nil || resp.StatusCode != 200 {
 			fmt.Println("server failed to connect", resp, err)
+			reader.Close()
 			continue
 		}
 		fmt.Println("server connected")
+		b.Reset()
 		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		reader.Close()
 		fmt.Println("server connection died")
 	}
 }
@@ -0,0 +1,43 @@
+package ntrip
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// countingWriter wraps an io.Writer, tracking the number of bytes written - the count is updated
+// atomically so it can be read while a connection is still being written to
+type countingWriter struct {
+	// count is the first field to guarantee 64-bit alignment for atomic operations on 32-bit
+	// platforms
+	count int64
+	io.Writer
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	atomic.AddInt64(&cw.count, int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes written so far
+func (cw *countingWriter) Count() int64 {
+	return atomic.LoadInt64(&cw.count)
+}
+
+// countingReader is the io.Reader equivalent of countingWriter
+type countingReader struct {
+	count int64
+	io.Reader
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	atomic.AddInt64(&cr.count, int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes read so far
+func (cr *countingReader) Count() int64 {
+	return atomic.LoadInt64(&cr.count)
+}
@@ -0,0 +1,77 @@
+package ntrip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCountingWriterConcurrent(t *testing.T) {
+	cw := &countingWriter{Writer: ioutil.Discard}
+	data := []byte("some test data")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cw.Write(data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if expected := int64(10 * 100 * len(data)); cw.Count() != expected {
+		t.Errorf("expected count %d, received %d", expected, cw.Count())
+	}
+}
+
+func TestCountingReaderConcurrent(t *testing.T) {
+	data := strings.Repeat("some test data", 1000)
+	cr := &countingReader{Reader: &lockedReader{r: strings.NewReader(data)}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 7)
+			for {
+				if _, err := cr.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if cr.Count() != int64(len(data)) {
+		t.Errorf("expected count %d, received %d", len(data), cr.Count())
+	}
+}
+
+func TestCountingWriterSequential(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cw := &countingWriter{Writer: buf}
+	cw.Write([]byte("first"))
+	cw.Write([]byte("second"))
+
+	if cw.Count() != int64(buf.Len()) {
+		t.Errorf("expected count %d, received %d", buf.Len(), cw.Count())
+	}
+}
+
+// strings.Reader is not safe for concurrent use
+type lockedReader struct {
+	sync.Mutex
+	r *strings.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Read(p)
+}
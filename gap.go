@@ -0,0 +1,102 @@
+package ntrip
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// GapPolicy decides what the Caster does when a publisher sends no data for its gap timeout
+type GapPolicy int
+
+const (
+	// LogGap logs a warning and keeps the publisher connected, in case data resumes
+	LogGap GapPolicy = iota
+	// DisconnectSilentPublisher logs a warning and closes the publisher's connection, which takes
+	// its mount offline
+	DisconnectSilentPublisher
+)
+
+// gapReader wraps a publisher's request body, logging a warning and counting a gap when no data
+// has been read for the timeout period and logging again when data resumes - this catches base
+// stations which stop sending data while keeping their connection open
+type gapReader struct {
+	io.Reader
+	timeout time.Duration
+	gaps    prometheus.Counter
+	logger  logrus.FieldLogger
+	// disconnect is called, if set, when a gap starts - it must unblock Read, which then returns
+	// an error
+	disconnect func()
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	lastRead time.Time
+	inGap    bool
+}
+
+func newGapReader(r io.Reader, timeout time.Duration, gaps prometheus.Counter, disconnect func(), logger logrus.FieldLogger) *gapReader {
+	g := &gapReader{
+		Reader:     r,
+		timeout:    timeout,
+		gaps:       gaps,
+		disconnect: disconnect,
+		logger:     logger,
+		lastRead:   time.Now(),
+	}
+	g.timer = time.AfterFunc(timeout, g.gap)
+	return g
+}
+
+func (g *gapReader) Read(p []byte) (int, error) {
+	n, err := g.Reader.Read(p)
+	if n > 0 {
+		g.received()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.inGap && g.disconnect != nil {
+		return n, fmt.Errorf("no data received from publisher for %s", g.timeout)
+	}
+	return n, err
+}
+
+// Stop must be called once the reader is no longer in use to stop the gap timer
+func (g *gapReader) Stop() {
+	g.timer.Stop()
+}
+
+// Called by timer when no data has been read for the timeout period
+func (g *gapReader) gap() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.inGap = true
+	g.gaps.Inc()
+	g.logger.Warnf("no data received from publisher for %s", g.timeout)
+	if g.disconnect != nil {
+		g.disconnect()
+	}
+}
+
+func (g *gapReader) received() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.inGap {
+		// Data which arrives while the publisher is being disconnected doesn't end the gap
+		if g.disconnect != nil {
+			return
+		}
+		g.inGap = false
+		g.logger.Infof("publisher data resumed after %s", time.Since(g.lastRead))
+	}
+
+	g.lastRead = time.Now()
+	g.timer.Reset(g.timeout)
+}
@@ -6,6 +6,8 @@ require (
 	github.com/gobuffalo/httptest v1.5.0
 	github.com/google/uuid v1.1.1
 	github.com/pkg/errors v0.9.1
-	github.com/sirupsen/logrus v1.4.2
+	github.com/prometheus/client_golang v1.11.1
+	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/text v0.3.8
 )
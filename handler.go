@@ -5,12 +5,22 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Value of the Retry-After header sent with 503 responses, in seconds
+const retryAfterSeconds = 60
+
+// Returned by the v2 handlers if the ResponseWriter can't be flushed, which may be the case when
+// the Caster's Handler is wrapped in middleware - results in a 500 response
+var errFlushNotSupported = fmt.Errorf("response writer does not support flushing")
+
 // handler is used by Caster, and is an instance of a request being handled with methods
 // for handing v1 and v2 requests
 // TODO: Better name - the http.Handler constructs this and uses it's methods for handling
@@ -19,6 +29,7 @@ import (
 type handler struct {
 	svc    SourceService
 	logger logrus.FieldLogger
+	caster *Caster
 }
 
 func (h *handler) handleRequest(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +74,13 @@ func (h *handler) handleRequestV1(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if mountName(r) == "" {
+		h.logger.Info("rejecting request with empty mount name")
+		writeStatusV1(rw, h.realm(r), http.StatusNotFound)
+		rw.Flush()
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		h.handleGetMountV1(rw, r)
@@ -88,17 +106,26 @@ func (h *handler) handleGetSourcetableV1(w *bufio.ReadWriter, r *http.Request) {
 }
 
 func (h *handler) handleGetMountV1(w *bufio.ReadWriter, r *http.Request) {
-	username, password, _ := r.BasicAuth()
-	sub, err := h.svc.Subscriber(r.Context(), r.URL.Path[1:], username, password)
+	username, password, _ := credentials(h.caster, r)
+	// NTRIP v1 clients send GGA sentences on the hijacked connection
+	sub, err := h.subscribe(r, username, password, w.Reader)
 	if err != nil {
 		h.logger.Infof("connection refused with reason: %s", err)
+		h.caster.metrics.refused(err)
+		if err == ErrorNotFound && h.caster.ChallengeNotFound {
+			err = ErrorNotAuthorized
+		}
 		// NTRIP v1 says to return 401 for unauthorized, but sourcetable for any other error - this goes against that
 		if err == ErrorNotAuthorized {
-			writeStatusV1(w, r, http.StatusUnauthorized)
+			writeStatusV1(w, h.realm(r), http.StatusUnauthorized)
 		} else if err == ErrorNotFound {
-			writeStatusV1(w, r, http.StatusNotFound)
+			writeStatusV1(w, h.realm(r), http.StatusNotFound)
+		} else if err == ErrorUnavailable {
+			writeStatusV1(w, h.realm(r), http.StatusServiceUnavailable)
+		} else if err == ErrorTooManyConnections {
+			writeStatusV1(w, h.realm(r), http.StatusTooManyRequests)
 		} else {
-			writeStatusV1(w, r, http.StatusInternalServerError)
+			writeStatusV1(w, h.realm(r), http.StatusInternalServerError)
 		}
 		w.Flush()
 		return
@@ -114,9 +141,11 @@ func (h *handler) handleGetMountV1(w *bufio.ReadWriter, r *http.Request) {
 		return
 	}
 	h.logger.Infof("accepted request")
+	defer h.register(r, RoleSubscriber)()
 
-	err = write(r.Context(), sub, w, w.Flush)
-	h.logger.Infof("connection closed with reason: %s", err)
+	cw := &countingWriter{Writer: h.caster.metrics.writer(w, mountName(r))}
+	err = write(r.Context(), h.caster.shutdown, sub, cw, w.Flush, h.writeDeadline(r))
+	h.logger.WithField("bytes_written", cw.Count()).Infof("connection closed with reason: %s", err)
 }
 
 func (h *handler) handleRequestV2(w http.ResponseWriter, r *http.Request) {
@@ -126,6 +155,12 @@ func (h *handler) handleRequestV2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if mountName(r) == "" {
+		h.logger.Info("rejecting request with empty mount name")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	var err error
 
 	switch r.Method {
@@ -139,26 +174,53 @@ func (h *handler) handleRequestV2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err == ErrorNotFound && h.caster.ChallengeNotFound {
+		err = ErrorNotAuthorized
+	}
+
 	// TODO: Check errors in writes
 	switch err {
 	case nil:
 	case ErrorNotAuthorized:
-		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", r.URL.Path))
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", h.realm(r)))
 		w.WriteHeader(http.StatusUnauthorized)
 	case ErrorNotFound:
 		w.WriteHeader(http.StatusNotFound)
 	case ErrorConflict:
 		w.WriteHeader(http.StatusConflict)
+	case ErrorUnavailable:
+		w.Header().Add("Retry-After", fmt.Sprint(retryAfterSeconds))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case ErrorTooManyConnections:
+		w.WriteHeader(http.StatusTooManyRequests)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
 func (h *handler) handleGetSourcetableV2(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement sourcetable filtering support
-	st := h.svc.GetSourcetable().String()
+	// Filters are sent as the query string, such as "/?STR;;;RTCM 3.2" - unless it's being used
+	// for credentials
+	filter := ""
+	if _, _, fromQuery := credentials(h.caster, r); !fromQuery {
+		var err error
+		if filter, err = url.PathUnescape(r.URL.RawQuery); err != nil {
+			h.logger.Infof("rejecting invalid sourcetable filter: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	table, err := h.svc.GetSourcetable().Filter(filter)
+	if err != nil {
+		h.logger.Infof("rejecting invalid sourcetable filter: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	st := table.String()
 	w.Header().Add("Content-Length", fmt.Sprint(len(st)))
-	_, err := w.Write([]byte(st))
+	_, err = w.Write([]byte(st))
 	if err != nil {
 		h.logger.Warnf("error writing sourcetable to client: %s", err)
 		return
@@ -168,67 +230,258 @@ func (h *handler) handleGetSourcetableV2(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *handler) handlePostMountV2(w http.ResponseWriter, r *http.Request) error {
-	username, password, _ := r.BasicAuth()
-	pub, err := h.svc.Publisher(r.Context(), r.URL.Path[1:], username, password)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.logger.Error("response writer does not implement http.Flusher, cannot accept publisher")
+		return errFlushNotSupported
+	}
+
+	username, password, _ := credentials(h.caster, r)
+	pub, err := h.svc.Publisher(r.Context(), mountName(r), username, password)
 	if err != nil {
 		h.logger.Infof("connection refused with reason: %s", err)
+		h.caster.metrics.refused(err)
 		return err
 	}
 	defer pub.Close()
 
-	// Write response headers in order for client to begin sending data
-	// TODO: Check if type cast is successful
-	w.(http.Flusher).Flush()
+	// Write response headers in order for client to begin sending data, explicitly rather than
+	// relying on Flush's implicit 200 since some servers wait for the NTRIP version header
+	w.Header().Set(NTRIPVersionHeaderKey, NTRIPVersionHeaderValueV2)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 	h.logger.Infof("accepted request")
+	defer h.register(r, RolePublisher)()
+
+	var body io.Reader = r.Body
+	if timeout := h.caster.gapTimeout(mountName(r)); timeout > 0 {
+		var disconnect func()
+		if h.caster.GapPolicy == DisconnectSilentPublisher {
+			// Closing pub takes the mount offline straight away, rather than once Read returns
+			disconnect = func() {
+				pub.Close()
+				h.abortBody(r)
+			}
+		}
+		gr := newGapReader(r.Body, timeout, h.caster.metrics.gaps(mountName(r)), disconnect, h.logger)
+		defer gr.Stop()
+		body = gr
+	}
+
+	if h.caster.MaxPublishBitrate > 0 && h.caster.PublishBitrateWindow > 0 {
+		body = newBitrateReader(body, h.caster.MaxPublishBitrate, h.caster.PublishBitrateWindow, h.caster.BitratePolicy, h.logger)
+	}
 
-	_, err = io.Copy(pub, r.Body)
+	cr := &countingReader{Reader: h.caster.metrics.reader(body, mountName(r))}
+	_, err = io.Copy(pub, cr)
 	if err == nil {
 		// TODO: Also check for "unexpected EOF"
 		err = fmt.Errorf("request body closed")
 	}
 
 	// Duplicating connection closed message here to avoid superfluous calls to WriteHeader
-	h.logger.Infof("connection closed with reason: %s", err)
+	h.logger.WithField("bytes_read", cr.Count()).Infof("connection closed with reason: %s", err)
 	return nil
 }
 
 func (h *handler) handleGetMountV2(w http.ResponseWriter, r *http.Request) error {
-	username, password, _ := r.BasicAuth()
-	sub, err := h.svc.Subscriber(r.Context(), r.URL.Path[1:], username, password)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.logger.Error("response writer does not implement http.Flusher, cannot stream data to subscriber")
+		return errFlushNotSupported
+	}
+
+	username, password, _ := credentials(h.caster, r)
+	sub, err := h.subscribe(r, username, password, r.Body)
 	if err != nil {
 		h.logger.Infof("connection refused with reason: %s", err)
+		h.caster.metrics.refused(err)
 		return err
 	}
 
 	w.Header().Add("Content-Type", "gnss/data")
 	// Flush response headers before sending data to client, default status code is 200
 	// TODO: Don't necessarily need to do this, since the first data written to client will flush
-	w.(http.Flusher).Flush()
+	flusher.Flush()
 	h.logger.Infof("accepted request")
+	defer h.register(r, RoleSubscriber)()
 
 	// bufio.ReadWriter's Flush method (used by v1 handler) returns error so does not satisfy the
 	// http.Flusher interface
 	flush := func() error {
-		// TODO: Check if cast succeeds and return error if not
-		w.(http.Flusher).Flush()
+		flusher.Flush()
 		return nil
 	}
 
-	err = write(r.Context(), sub, w, flush)
+	cw := &countingWriter{Writer: h.caster.metrics.writer(w, mountName(r))}
+	err = write(r.Context(), h.caster.shutdown, sub, cw, flush, h.writeDeadline(r))
+	h.abortBody(r)
 	// Duplicating connection closed message here to avoid superfluous calls to WriteHeader
-	h.logger.Infof("connection closed with reason: %s", err)
+	h.logger.WithField("bytes_written", cw.Count()).Infof("connection closed with reason: %s", err)
 	return nil
 }
 
-// Used by the GET handlers to read data from Subscriber channel and write to client writer
+// Stops reading the request body of a client which is still sending one, such as a VRS client
+// sending GGA sentences - otherwise a pending Read would block and closing the body would wait for
+// the client to finish sending it, which also holds up Shutdown. HTTP/2 bodies are closed instead,
+// which resets the stream and unblocks Read.
+func (h *handler) abortBody(r *http.Request) {
+	if r.Body == http.NoBody {
+		return
+	}
+	if r.ProtoMajor != 1 {
+		r.Body.Close()
+		return
+	}
+
+	conn, ok := r.Context().Value(connContextKey).(net.Conn)
+	if !ok {
+		return
+	}
+
+	// The connection isn't reused since v2 responses set "Connection: close"
+	if err := conn.SetReadDeadline(time.Now()); err != nil {
+		h.logger.WithError(err).Warn("error aborting request body")
+	}
+}
+
+// Calls the SourceService's SubscriberWithGGA if it implements GGASubscriber, passing it the GGA
+// sentence from the Ntrip-GGA header followed by those read from body, otherwise calls Subscriber
+func (h *handler) subscribe(r *http.Request, username, password string, body io.Reader) (chan []byte, error) {
+	ctx, mount := r.Context(), mountName(r)
+	gs, ok := h.svc.(GGASubscriber)
+	if !ok {
+		return h.svc.Subscriber(ctx, mount, username, password)
+	}
+
+	gga := make(chan GGA, 1)
+	if header := r.Header.Get(NTRIPGGAHeaderKey); header != "" {
+		// Buffered so can't block
+		if position, err := ParseGGA(strings.TrimSpace(header)); err == nil {
+			gga <- position
+		} else {
+			h.logger.Debugf("ignoring invalid %s header: %s", NTRIPGGAHeaderKey, err)
+		}
+	}
+
+	go readGGA(ctx, body, gga, h.logger)
+	sub, err := gs.SubscriberWithGGA(ctx, mount, username, password, gga)
+	if err != nil {
+		// Stops readGGA reading the request body after the handler returns
+		h.abortBody(r)
+	}
+	return sub, err
+}
+
+// Reads lines from r, writing valid GGA sentences to gga and closing it once r is closed
+func readGGA(ctx context.Context, r io.Reader, gga chan GGA, logger logrus.FieldLogger) {
+	defer close(gga)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		position, err := ParseGGA(line)
+		if err != nil {
+			logger.Debugf("ignoring invalid GGA sentence from client: %s", err)
+			continue
+		}
+
+		select {
+		case gga <- position:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Registers an accepted connection with the Caster's ConnectionRegistry and calls the OnConnect
+// callback, returning a function which deregisters it and calls OnDisconnect
+func (h *handler) register(r *http.Request, role Role) func() {
+	username, _, _ := credentials(h.caster, r)
+	conn := Connection{
+		ID:         RequestID(r.Context()),
+		Mount:      mountName(r),
+		Username:   username,
+		Role:       role,
+		RemoteAddr: r.RemoteAddr,
+		Connected:  time.Now(),
+	}
+
+	registered := false
+	if h.caster.Registry != nil {
+		if err := h.caster.Registry.Register(conn); err != nil {
+			h.logger.WithError(err).Warn("error registering connection")
+		} else {
+			registered = true
+		}
+	}
+
+	if h.caster.OnConnect != nil {
+		h.caster.OnConnect(conn)
+	}
+
+	disconnected := h.caster.metrics.connected(conn.Mount, role)
+	return func() {
+		disconnected()
+
+		if registered {
+			if err := h.caster.Registry.Deregister(conn.ID); err != nil {
+				h.logger.WithError(err).Warn("error deregistering connection")
+			}
+		}
+
+		if h.caster.OnDisconnect != nil {
+			h.caster.OnDisconnect(conn)
+		}
+	}
+}
+
+// Returns the Basic auth credentials from r, falling back to the user and pass query parameters if
+// the Caster's QueryCredentials option is set and the request has no Authorization header
+func credentials(c *Caster, r *http.Request) (username, password string, fromQuery bool) {
+	header := r.Header.Get("Authorization")
+	if username, password, ok := ParseBasicAuth(header); ok || !c.QueryCredentials || header != "" {
+		return username, password, false
+	}
+
+	query := r.URL.Query()
+	if query.Get("user") == "" {
+		return "", "", false
+	}
+	return query.Get("user"), query.Get("pass"), true
+}
+
+// Returns the realm for authentication challenges, which is the Caster's Realm if set or
+// otherwise the request path
+func (h *handler) realm(r *http.Request) string {
+	if h.caster.Realm != "" {
+		return h.caster.Realm
+	}
+	return r.URL.Path
+}
+
+// Returns the mount name requested by r, which is the path without leading or trailing slashes
+func mountName(r *http.Request) string {
+	return strings.Trim(r.URL.Path, "/")
+}
+
+// Used by the GET handlers to read data from Subscriber channel and write to client writer, until
+// the client disconnects or shutdown is closed
 // TODO: Better name
-func write(ctx context.Context, c chan []byte, w io.Writer, flush func() error) error {
+func write(ctx context.Context, shutdown <-chan struct{}, c chan []byte, w io.Writer, flush func() error, deadline func() error) error {
 	for {
 		select {
 		case data, ok := <-c:
 			if !ok {
 				return fmt.Errorf("subscriber channel closed")
 			}
+			if err := deadline(); err != nil {
+				return err
+			}
 			if _, err := w.Write(data); err != nil {
 				return err
 			}
@@ -237,12 +490,28 @@ func write(ctx context.Context, c chan []byte, w io.Writer, flush func() error)
 			}
 		case <-ctx.Done():
 			return fmt.Errorf("client disconnect")
+		case <-shutdown:
+			return fmt.Errorf("caster shutdown")
 		}
 	}
 }
 
+// Returns a function which sets the write deadline of r's connection to the Caster's
+// SubscriberWriteTimeout from now, to be called before each write to a subscriber
+func (h *handler) writeDeadline(r *http.Request) func() error {
+	conn, ok := r.Context().Value(connContextKey).(net.Conn)
+	// HTTP/2 connections are shared by multiple requests, so their deadlines aren't set
+	if !ok || h.caster.SubscriberWriteTimeout <= 0 || r.ProtoMajor != 1 {
+		return func() error { return nil }
+	}
+
+	return func() error {
+		return conn.SetWriteDeadline(time.Now().Add(h.caster.SubscriberWriteTimeout))
+	}
+}
+
 // Spec says that WWW-Authenticate header is required for casters
-func writeStatusV1(w io.Writer, r *http.Request, statusCode int) error {
+func writeStatusV1(w io.Writer, realm string, statusCode int) error {
 	// TODO: Not sure about setting the HTTP version
 	// TODO: Check for errors writing and flushing
 	resp := http.Response{
@@ -250,9 +519,12 @@ func writeStatusV1(w io.Writer, r *http.Request, statusCode int) error {
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		Header: map[string][]string{
-			"WWW-Authenticate": {fmt.Sprintf("Basic realm=%q", r.URL.Path)},
+			"WWW-Authenticate": {fmt.Sprintf("Basic realm=%q", realm)},
 		},
 		Close: true,
 	}
+	if statusCode == http.StatusServiceUnavailable {
+		resp.Header.Add("Retry-After", fmt.Sprint(retryAfterSeconds))
+	}
 	return resp.Write(w)
 }
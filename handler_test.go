@@ -2,19 +2,25 @@ package ntrip_test
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-gnss/ntrip"
+	"github.com/go-gnss/ntrip/internal/inmemory"
 	"github.com/go-gnss/ntrip/internal/mock"
+	"github.com/go-gnss/ntrip/ntriptest"
 	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 )
 
 var (
@@ -219,3 +225,918 @@ func TestMountInUse(t *testing.T) {
 		t.Errorf("expected response status code %d, received %d", http.StatusConflict, rr.Code)
 	}
 }
+
+func TestMountMaintenance(t *testing.T) {
+	cases := []struct {
+		TestName     string
+		NTRIPVersion int
+		ResponseCode int
+		ResponseBody string
+	}{
+		{"v2 GET Maintenance", 2, http.StatusServiceUnavailable, ""},
+		{"v1 GET Maintenance", 1, 0, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nRetry-After: 60\r\nWWW-Authenticate: Basic realm=\"/TEST00AUS0\"\r\nContent-Length: 0\r\n\r\n"},
+	}
+
+	for _, tc := range cases {
+		ms := mock.NewMockSourceService()
+		ms.Maintenance = true
+
+		req, _ := http.NewRequest(http.MethodGet, mock.MountPath, strings.NewReader(""))
+		if tc.NTRIPVersion == 2 {
+			req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		}
+		req.SetBasicAuth(mock.Username, mock.Password)
+
+		rr := &HijackableResponseRecorder{httptest.NewRecorder()}
+		rr.Code = 0
+		ntrip.NewCaster("N/A", ms, logger).Handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.ResponseCode {
+			t.Errorf("error in %s: expected response code %d, received %d", tc.TestName, tc.ResponseCode, rr.Code)
+		}
+
+		if rr.Body.String() != tc.ResponseBody {
+			t.Errorf("error in %s: expected response body %q, received %q", tc.TestName, tc.ResponseBody, rr.Body.String())
+		}
+
+		if tc.NTRIPVersion == 2 && rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("error in %s: expected Retry-After header %q, received %q", tc.TestName, "60", rr.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// panicSourceService panics with value when a client subscribes, or when a publisher writes data
+type panicSourceService struct {
+	*mock.MockSourceService
+	value interface{}
+}
+
+func (p *panicSourceService) Subscriber(ctx context.Context, mount, username, password string) (chan []byte, error) {
+	panic(p.value)
+}
+
+func (p *panicSourceService) Publisher(ctx context.Context, mount, username, password string) (io.WriteCloser, error) {
+	return p, nil
+}
+
+func (p *panicSourceService) Write(b []byte) (int, error) {
+	panic(p.value)
+}
+
+func (p *panicSourceService) Close() error {
+	return nil
+}
+
+func TestHandlerPanic(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, mock.MountPath, strings.NewReader(""))
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+
+	rr := httptest.NewRecorder()
+	ntrip.NewCaster("N/A", &panicSourceService{mock.NewMockSourceService(), "intentionally triggered panic"}, logger).Handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected response status code %d, received %d", http.StatusInternalServerError, rr.Code)
+	}
+}
+
+func TestHandlerPanicAfterResponse(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, mock.MountPath, strings.NewReader("data"))
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+
+	rr := httptest.NewRecorder()
+	ntrip.NewCaster("N/A", &panicSourceService{mock.NewMockSourceService(), "intentionally triggered panic"}, logger).Handler.ServeHTTP(rr, req)
+
+	// The publisher's 200 response has already been sent, so no error response should follow
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("expected empty %d response, received %d %q", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandlerPanicAbort(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, mock.MountPath, strings.NewReader(""))
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected panic %v to reach the server, received %v", http.ErrAbortHandler, p)
+		}
+	}()
+
+	rr := httptest.NewRecorder()
+	ntrip.NewCaster("N/A", &panicSourceService{mock.NewMockSourceService(), http.ErrAbortHandler}, logger).Handler.ServeHTTP(rr, req)
+}
+
+func TestPublisherGap(t *testing.T) {
+	gapLogger, hook := test.NewNullLogger()
+	caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), gapLogger)
+	caster.PublisherGapTimeout = 50 * time.Millisecond
+
+	r, w := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, mock.MountPath, r)
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		caster.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	w.Write([]byte("first burst"))
+	time.Sleep(150 * time.Millisecond)
+	expectMetrics(t, caster.MetricsHandler(), fmt.Sprintf(`ntrip_publisher_gaps_total{mount=%q} 1`, mock.MountName))
+	w.Write([]byte("second burst"))
+	w.Close()
+	<-done
+
+	gaps, resumes := 0, 0
+	for _, entry := range hook.AllEntries() {
+		switch {
+		case strings.HasPrefix(entry.Message, "no data received from publisher"):
+			gaps++
+		case strings.HasPrefix(entry.Message, "publisher data resumed"):
+			resumes++
+		}
+	}
+
+	if gaps != 1 || resumes != 1 {
+		t.Errorf("expected 1 gap and 1 resume log, received %d and %d", gaps, resumes)
+	}
+}
+
+type allowAll struct{}
+
+func (_ allowAll) Authorise(action inmemory.Action, mount, username, password string) (bool, error) {
+	return true, nil
+}
+
+func TestMountGapTimeouts(t *testing.T) {
+	gapLogger, hook := test.NewNullLogger()
+	caster := ntrip.NewCaster("N/A", inmemory.NewSourceService(allowAll{}), gapLogger)
+	caster.MountGapTimeouts = map[string]time.Duration{
+		"FAST": 50 * time.Millisecond,
+		"SLOW": 1 * time.Second,
+	}
+
+	var wg sync.WaitGroup
+	for _, mount := range []string{"FAST", "SLOW"} {
+		wg.Add(1)
+		go func(mount string) {
+			defer wg.Done()
+			r, w := io.Pipe()
+			go func() {
+				w.Write([]byte("first burst"))
+				time.Sleep(150 * time.Millisecond)
+				w.Write([]byte("second burst"))
+				w.Close()
+			}()
+
+			req, _ := http.NewRequest(http.MethodPost, "/"+mount, r)
+			req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+			caster.Handler.ServeHTTP(httptest.NewRecorder(), req)
+		}(mount)
+	}
+	wg.Wait()
+
+	gaps := map[interface{}]int{}
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "no data received from publisher") {
+			gaps[entry.Data["path"]]++
+		}
+	}
+
+	if gaps["/FAST"] != 1 || gaps["/SLOW"] != 0 {
+		t.Errorf("expected 1 gap for FAST and none for SLOW, received %v", gaps)
+	}
+}
+
+func TestDisconnectSilentPublisher(t *testing.T) {
+	server := ntriptest.NewServer()
+	defer server.Close()
+	server.Caster.GapPolicy = ntrip.DisconnectSilentPublisher
+	server.Caster.MountGapTimeouts = map[string]time.Duration{
+		"FAST": 50 * time.Millisecond,
+		"SLOW": 5 * time.Second,
+	}
+
+	for _, mount := range []string{"FAST", "SLOW"} {
+		pub, err := server.Publish(mount)
+		if err != nil {
+			t.Fatalf("error publishing to %s: %s", mount, err)
+		}
+		defer pub.Close()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		sub, err := server.Subscribe("FAST")
+		if err != nil {
+			break
+		}
+		sub.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected silent publisher's mount to go offline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sub, err := server.Subscribe("SLOW")
+	if err != nil {
+		t.Fatalf("expected mount with longer timeout to stay online, received error: %s", err)
+	}
+	sub.Close()
+}
+
+func TestMaxPublishBitrate(t *testing.T) {
+	cases := []struct {
+		Policy     ntrip.BitratePolicy
+		BytesRead  int64
+		Disconnect bool
+	}{
+		{ntrip.LogBitrate, 3000, false},
+		{ntrip.DisconnectPublisher, 1000, true},
+	}
+
+	for _, tc := range cases {
+		bitrateLogger, hook := test.NewNullLogger()
+		caster := ntrip.NewCaster("N/A", inmemory.NewSourceService(allowAll{}), bitrateLogger)
+		caster.MaxPublishBitrate = 800
+		caster.PublishBitrateWindow = time.Second
+		caster.BitratePolicy = tc.Policy
+
+		// Each write is over the limit of 100 bytes per second by itself
+		r, w := io.Pipe()
+		go func() {
+			for i := 0; i < 3; i++ {
+				if _, err := w.Write(make([]byte, 1000)); err != nil {
+					break
+				}
+			}
+			w.Close()
+		}()
+
+		req, _ := http.NewRequest(http.MethodPost, "/MOUNT", r)
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		caster.Handler.ServeHTTP(httptest.NewRecorder(), req)
+		r.Close()
+
+		warnings := 0
+		var closed *logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "publisher bitrate of") {
+				warnings++
+			}
+			if strings.HasPrefix(entry.Message, "connection closed with reason") {
+				closed = entry
+			}
+		}
+
+		if warnings != 1 {
+			t.Errorf("policy %d: expected 1 bitrate warning, received %d", tc.Policy, warnings)
+		}
+		if closed == nil {
+			t.Fatalf("policy %d: expected connection closed log", tc.Policy)
+		}
+		if closed.Data["bytes_read"] != tc.BytesRead {
+			t.Errorf("policy %d: expected %d bytes read, received %v", tc.Policy, tc.BytesRead, closed.Data["bytes_read"])
+		}
+		if disconnected := strings.Contains(closed.Message, "exceeded maximum bitrate"); disconnected != tc.Disconnect {
+			t.Errorf("policy %d: expected disconnect %t, received close reason %q", tc.Policy, tc.Disconnect, closed.Message)
+		}
+	}
+}
+
+func TestSourcetableFilterRequest(t *testing.T) {
+	ms := mock.NewMockSourceService()
+	ms.Sourcetable.Mounts = []ntrip.StreamEntry{
+		{Name: "SYD", Format: "RTCM 3.2", CountryCode: "AUS"},
+		{Name: "BER", Format: "RTCM 3.2", CountryCode: "DEU"},
+	}
+	caster := ntrip.NewCaster("N/A", ms, logger)
+	caster.QueryCredentials = true
+
+	cases := []struct {
+		URL          string
+		ResponseCode int
+		ResponseBody string
+	}{
+		{"/", 200, ms.Sourcetable.String()},
+		{"/?STR;;;;;;;;DEU", 200, ntrip.Sourcetable{Mounts: ms.Sourcetable.Mounts[1:]}.String()},
+		{"/?STR;;;RTCM%203.2;;;;;AUS", 200, ntrip.Sourcetable{Mounts: ms.Sourcetable.Mounts[:1]}.String()},
+		{"/?BAD;filter", 400, ""},
+		{"/?STR;;;RTCM%2", 400, ""},
+		// The query string isn't a filter when it's used for credentials
+		{"/?user=" + mock.Username + "&pass=%zz", 200, ms.Sourcetable.String()},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(http.MethodGet, tc.URL, strings.NewReader(""))
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		rr := httptest.NewRecorder()
+		caster.Handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.ResponseCode {
+			t.Errorf("%s: expected response code %d, received %d", tc.URL, tc.ResponseCode, rr.Code)
+		}
+		if rr.Body.String() != tc.ResponseBody {
+			t.Errorf("%s: expected response body %q, received %q", tc.URL, tc.ResponseBody, rr.Body.String())
+		}
+	}
+}
+
+// Credentials must never be written to logs, for successful or failed requests
+func TestCredentialsNotLogged(t *testing.T) {
+	cases := []struct {
+		Method       string
+		Path         string
+		Password     string
+		NTRIPVersion int
+	}{
+		{http.MethodGet, mock.MountPath, mock.Password, 2},
+		{http.MethodGet, mock.MountPath, "incorrect-password", 2},
+		{http.MethodGet, mock.MountPath, mock.Password, 1},
+		{http.MethodGet, mock.MountPath, "incorrect-password", 1},
+		{http.MethodPost, mock.MountPath, mock.Password, 2},
+		{http.MethodPost, mock.MountPath, "incorrect-password", 2},
+		{http.MethodPut, mock.MountPath, "incorrect-password", 2},
+	}
+
+	for _, tc := range cases {
+		credLogger, hook := test.NewNullLogger()
+		credLogger.Level = logrus.DebugLevel
+
+		ms := mock.NewMockSourceService()
+		if tc.Method == http.MethodGet {
+			ms.DataChannel = make(chan []byte, 1)
+			ms.DataChannel <- []byte("data")
+			close(ms.DataChannel)
+		}
+
+		req, _ := http.NewRequest(tc.Method, tc.Path, strings.NewReader("data"))
+		if tc.NTRIPVersion == 2 {
+			req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		}
+		req.SetBasicAuth(mock.Username, tc.Password)
+		authHeader := req.Header.Get("Authorization")
+
+		rr := &HijackableResponseRecorder{httptest.NewRecorder()}
+		ntrip.NewCaster("N/A", ms, credLogger).Handler.ServeHTTP(rr, req)
+
+		for _, entry := range hook.AllEntries() {
+			line, _ := entry.String()
+			if strings.Contains(line, tc.Password) || strings.Contains(line, authHeader[len("Basic "):]) {
+				t.Errorf("credentials found in log line for v%d %s request: %s", tc.NTRIPVersion, tc.Method, line)
+			}
+		}
+	}
+}
+
+// nonFlushingResponseWriter hides the http.Flusher implementation of the wrapped ResponseWriter,
+// as some middleware does
+type nonFlushingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func TestNonFlushingResponseWriter(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		ms := mock.NewMockSourceService()
+		ms.DataChannel = make(chan []byte, 1)
+
+		req, _ := http.NewRequest(method, mock.MountPath, strings.NewReader(""))
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		req.SetBasicAuth(mock.Username, mock.Password)
+
+		rr := httptest.NewRecorder()
+		ntrip.NewCaster("N/A", ms, logger).Handler.ServeHTTP(nonFlushingResponseWriter{rr}, req)
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("expected response status code %d for %s request, received %d", http.StatusInternalServerError, method, rr.Code)
+		}
+	}
+}
+
+// ggaSourceService forwards the positions received from subscribers to a channel
+type ggaSourceService struct {
+	*mock.MockSourceService
+	positions chan ntrip.GGA
+}
+
+func (g *ggaSourceService) SubscriberWithGGA(ctx context.Context, mount, username, password string, gga <-chan ntrip.GGA) (chan []byte, error) {
+	go func() {
+		for position := range gga {
+			g.positions <- position
+		}
+	}()
+	return g.Subscriber(ctx, mount, username, password)
+}
+
+func TestSubscriberGGA(t *testing.T) {
+	gs := &ggaSourceService{mock.NewMockSourceService(), make(chan ntrip.GGA)}
+	gs.DataChannel = make(chan []byte, 1)
+
+	r, w := io.Pipe()
+	req, _ := http.NewRequest(http.MethodGet, mock.MountPath, r)
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+	req.Header.Add(ntrip.NTRIPGGAHeaderKey, "$GPGGA,000000,0130.000,N,00100.000,E,1,08,0.9,545.4,M,46.9,M,,*4B")
+
+	rr := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		ntrip.NewCaster("N/A", gs, logger).Handler.ServeHTTP(rr, req)
+		done <- true
+	}()
+
+	expectLatitude := func(latitude float64) {
+		select {
+		case position := <-gs.positions:
+			if math.Abs(position.Latitude-latitude) > 0.000001 {
+				t.Errorf("expected latitude %f, received %f", latitude, position.Latitude)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for position with latitude %f", latitude)
+		}
+	}
+
+	expectPosition := func(sentence string, latitude float64) {
+		w.Write([]byte(sentence + "\r\n"))
+		expectLatitude(latitude)
+	}
+
+	// The position from the Ntrip-GGA header is received before any sent in the body
+	expectLatitude(1.5)
+	expectPosition("$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47", 48.1173)
+	gs.DataChannel <- []byte("data")
+	// Invalid sentences are ignored
+	w.Write([]byte("not a GGA sentence\r\n"))
+	expectPosition("$GNGGA,012345.50,3512.3456,S,14907.8910,W,4,12,0.7,-10.5,M,12.0,M,1.0,0000*47", -35.205760)
+
+	close(gs.DataChannel)
+	<-done
+	w.Close()
+
+	if rr.Body.String() != "data" {
+		t.Errorf("expected response body %q, received %q", "data", rr.Body.String())
+	}
+}
+
+func TestSubscriberGGABodyAborted(t *testing.T) {
+	gs := &ggaSourceService{mock.NewMockSourceService(), make(chan ntrip.GGA, 1)}
+	gs.DataChannel = make(chan []byte, 1)
+	caster := ntrip.NewCaster("N/A", gs, logger)
+
+	done := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caster.Handler.ServeHTTP(w, r)
+		close(done)
+	}))
+	server.Config.ConnContext = caster.ConnContext
+	server.Start()
+	defer server.Close()
+
+	// The client keeps its request body open to send further GGA sentences
+	r, w := io.Pipe()
+	defer w.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+mock.MountPath, r)
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+	go w.Write([]byte("$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\r\n"))
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("error connecting subscriber: %s", err)
+	}
+	defer resp.Body.Close()
+
+	select {
+	case <-gs.positions:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for position")
+	}
+
+	// Publisher disconnects
+	close(gs.DataChannel)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("handler did not return while the client's request body was open")
+	}
+}
+
+// refusingGGASourceService refuses subscribers, closing closed once their GGA channel is closed
+type refusingGGASourceService struct {
+	*mock.MockSourceService
+	closed chan struct{}
+}
+
+func (rs *refusingGGASourceService) SubscriberWithGGA(ctx context.Context, mount, username, password string, gga <-chan ntrip.GGA) (chan []byte, error) {
+	go func() {
+		for range gga {
+		}
+		close(rs.closed)
+	}()
+	return nil, ntrip.ErrorNotAuthorized
+}
+
+func TestRefusedSubscriberGGABodyAborted(t *testing.T) {
+	rs := &refusingGGASourceService{mock.NewMockSourceService(), make(chan struct{})}
+	caster := ntrip.NewCaster("N/A", rs, logger)
+	server := httptest.NewUnstartedServer(caster.Handler)
+	server.Config.ConnContext = caster.ConnContext
+	server.Start()
+	defer server.Close()
+
+	// The client keeps its request body open to send further GGA sentences
+	r, w := io.Pipe()
+	defer w.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL+mock.MountPath, r)
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+
+	go func() {
+		if resp, err := server.Client().Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	select {
+	case <-rs.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("request body still being read after the subscriber was refused")
+	}
+}
+
+func TestMountPaths(t *testing.T) {
+	cases := []struct {
+		Method       string
+		Path         string
+		NTRIPVersion int
+		ResponseCode int
+		ResponseBody string
+	}{
+		{http.MethodGet, "//", 2, 404, ""},
+		{http.MethodPost, "///", 2, 404, ""},
+		{http.MethodGet, mock.MountPath + "/", 2, 200, "data"},
+		{http.MethodPost, mock.MountPath + "/", 2, 200, ""},
+		{http.MethodGet, "//", 1, 0, "HTTP/1.1 404 Not Found\r\nConnection: close\r\nWWW-Authenticate: Basic realm=\"//\"\r\nContent-Length: 0\r\n\r\n"},
+		{http.MethodGet, mock.MountPath + "/", 1, 0, "ICY 200 OK\r\ndata"},
+	}
+
+	for _, tc := range cases {
+		ms := mock.NewMockSourceService()
+		if tc.Method == http.MethodGet {
+			ms.DataChannel = make(chan []byte, 1)
+			ms.DataChannel <- []byte("data")
+			close(ms.DataChannel)
+		}
+
+		// http.NewRequest would parse "//" as a URL with an empty host and path
+		req, _ := http.NewRequest(tc.Method, "/", strings.NewReader("data"))
+		req.URL.Path = tc.Path
+		if tc.NTRIPVersion == 2 {
+			req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		}
+		req.SetBasicAuth(mock.Username, mock.Password)
+
+		rr := &HijackableResponseRecorder{httptest.NewRecorder()}
+		rr.Code = 0
+		ntrip.NewCaster("N/A", ms, logger).Handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.ResponseCode {
+			t.Errorf("v%d %s %q: expected response code %d, received %d", tc.NTRIPVersion, tc.Method, tc.Path, tc.ResponseCode, rr.Code)
+		}
+		if rr.Body.String() != tc.ResponseBody {
+			t.Errorf("v%d %s %q: expected response body %q, received %q", tc.NTRIPVersion, tc.Method, tc.Path, tc.ResponseBody, rr.Body.String())
+		}
+	}
+}
+
+func TestQueryCredentials(t *testing.T) {
+	cases := []struct {
+		TestName         string
+		URL              string
+		BasicAuth        bool
+		QueryCredentials bool
+		ResponseCode     int
+		Warning          bool
+	}{
+		{"Header", mock.MountPath, true, true, 200, false},
+		{"Query", mock.MountPath + "?user=" + mock.Username + "&pass=" + mock.Password, false, true, 200, true},
+		{"Query Disabled", mock.MountPath + "?user=" + mock.Username + "&pass=" + mock.Password, false, false, 401, false},
+		{"Query Wrong Password", mock.MountPath + "?user=" + mock.Username + "&pass=wrong", false, true, 401, true},
+	}
+
+	for _, tc := range cases {
+		queryLogger, hook := test.NewNullLogger()
+
+		ms := mock.NewMockSourceService()
+		ms.DataChannel = make(chan []byte, 1)
+		close(ms.DataChannel)
+
+		req, _ := http.NewRequest(http.MethodGet, tc.URL, strings.NewReader(""))
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		if tc.BasicAuth {
+			req.SetBasicAuth(mock.Username, mock.Password)
+		}
+
+		caster := ntrip.NewCaster("N/A", ms, queryLogger)
+		caster.QueryCredentials = tc.QueryCredentials
+		rr := httptest.NewRecorder()
+		caster.Handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.ResponseCode {
+			t.Errorf("error in %s: expected response code %d, received %d", tc.TestName, tc.ResponseCode, rr.Code)
+		}
+
+		warned := false
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel && strings.HasPrefix(entry.Message, "using credentials from query string") {
+				warned = true
+			}
+		}
+		if warned != tc.Warning {
+			t.Errorf("error in %s: expected query credentials warning %t, received %t", tc.TestName, tc.Warning, warned)
+		}
+	}
+}
+
+func TestRealm(t *testing.T) {
+	cases := []struct {
+		Realm        string
+		NTRIPVersion int
+		Challenge    string
+	}{
+		{"", 2, `Basic realm="/TEST00AUS0"`},
+		{"MyCaster", 2, `Basic realm="MyCaster"`},
+		{"", 1, `Basic realm="/TEST00AUS0"`},
+		{"MyCaster", 1, `Basic realm="MyCaster"`},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(http.MethodGet, mock.MountPath, strings.NewReader(""))
+		if tc.NTRIPVersion == 2 {
+			req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		}
+
+		caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), logger)
+		caster.Realm = tc.Realm
+		rr := &HijackableResponseRecorder{httptest.NewRecorder()}
+		caster.Handler.ServeHTTP(rr, req)
+
+		challenge := rr.Header().Get("WWW-Authenticate")
+		if tc.NTRIPVersion == 1 {
+			// v1 headers are written to the hijacked connection
+			resp, err := http.ReadResponse(bufio.NewReader(rr.Body), req)
+			if err != nil {
+				t.Fatalf("error reading v1 response: %s", err)
+			}
+			challenge = resp.Header.Get("WWW-Authenticate")
+		}
+
+		if challenge != tc.Challenge {
+			t.Errorf("v%d with realm %q: expected challenge %q, received %q", tc.NTRIPVersion, tc.Realm, tc.Challenge, challenge)
+		}
+	}
+}
+
+func TestChallengeNotFound(t *testing.T) {
+	cases := []struct {
+		ChallengeNotFound bool
+		Method            string
+		Path              string
+		ResponseCode      int
+	}{
+		{false, http.MethodGet, "/NotFound", 404},
+		{true, http.MethodGet, "/NotFound", 401},
+		{true, http.MethodPost, "/NotFound", 401},
+		{true, http.MethodGet, mock.MountPath, 401},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.Method, tc.Path, strings.NewReader(""))
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		// Valid credentials, but the mock only has mock.MountName so other mounts are not found
+		if tc.Path != mock.MountPath {
+			req.SetBasicAuth(mock.Username, mock.Password)
+		}
+
+		caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), logger)
+		caster.ChallengeNotFound = tc.ChallengeNotFound
+		rr := httptest.NewRecorder()
+		caster.Handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.ResponseCode {
+			t.Errorf("%s %s with ChallengeNotFound %t: expected response code %d, received %d", tc.Method, tc.Path, tc.ChallengeNotFound, tc.ResponseCode, rr.Code)
+		}
+		if tc.ResponseCode == 401 && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s with ChallengeNotFound %t: expected WWW-Authenticate header", tc.Method, tc.Path, tc.ChallengeNotFound)
+		}
+	}
+
+	// v1 already includes a challenge with 404 responses, but the status code is also changed
+	req, _ := http.NewRequest(http.MethodGet, "/NotFound", strings.NewReader(""))
+	req.SetBasicAuth(mock.Username, mock.Password)
+	caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), logger)
+	caster.ChallengeNotFound = true
+	rr := &HijackableResponseRecorder{httptest.NewRecorder()}
+	caster.Handler.ServeHTTP(rr, req)
+
+	if !strings.HasPrefix(rr.Body.String(), "HTTP/1.1 401 Unauthorized\r\n") {
+		t.Errorf("v1 GET with ChallengeNotFound: expected 401 response, received %q", rr.Body.String())
+	}
+}
+
+// requestIDSourceService records the request IDs and remote addresses in the contexts passed to it
+type requestIDSourceService struct {
+	*mock.MockSourceService
+	ids   []string
+	addrs []string
+}
+
+func (rs *requestIDSourceService) Publisher(ctx context.Context, mount, username, password string) (io.WriteCloser, error) {
+	rs.ids = append(rs.ids, ntrip.RequestID(ctx))
+	rs.addrs = append(rs.addrs, ntrip.RemoteAddr(ctx))
+	return rs.MockSourceService.Publisher(ctx, mount, username, password)
+}
+
+func (rs *requestIDSourceService) Subscriber(ctx context.Context, mount, username, password string) (chan []byte, error) {
+	rs.ids = append(rs.ids, ntrip.RequestID(ctx))
+	rs.addrs = append(rs.addrs, ntrip.RemoteAddr(ctx))
+	return rs.MockSourceService.Subscriber(ctx, mount, username, password)
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		idLogger, hook := test.NewNullLogger()
+		rs := &requestIDSourceService{MockSourceService: mock.NewMockSourceService()}
+		if method == http.MethodGet {
+			rs.DataChannel = make(chan []byte, 1)
+			close(rs.DataChannel)
+		}
+
+		req, _ := http.NewRequest(method, mock.MountPath, strings.NewReader(""))
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		req.SetBasicAuth(mock.Username, mock.Password)
+		ntrip.NewCaster("N/A", rs, idLogger).Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if len(rs.ids) != 1 || rs.ids[0] == "" {
+			t.Fatalf("%s: expected a request ID in the SourceService context, received %v", method, rs.ids)
+		}
+		if rs.addrs[0] != req.RemoteAddr {
+			t.Errorf("%s: expected remote address %q in the SourceService context, received %q", method, req.RemoteAddr, rs.addrs[0])
+		}
+
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["request_id"] != rs.ids[0] {
+				t.Errorf("%s: expected request_id %q in log fields, received %v", method, rs.ids[0], entry.Data["request_id"])
+			}
+		}
+	}
+
+	if id := ntrip.RequestID(context.Background()); id != "" {
+		t.Errorf("expected empty request ID for context without one, received %q", id)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	ms := mock.NewMockSourceService()
+	ms.DataChannel = make(chan []byte)
+	caster := ntrip.NewCaster("N/A", ms, logger)
+	caster.MaxConnectionsPerIP = 2
+
+	request := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, path, strings.NewReader(""))
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		req.SetBasicAuth(mock.Username, mock.Password)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		caster.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Subscribers stay connected until the data channel is closed
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request(mock.MountPath, fmt.Sprintf("192.0.2.1:%d", 1000+i))
+		}(i)
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conns, _ := caster.Registry.Connections(); len(conns) == 2 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("timeout waiting for subscribers to connect")
+		}
+	}
+
+	if rr := request("/", "192.0.2.1:1002"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected response code %d for third connection, received %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr := request("/", "192.0.2.2:1000"); rr.Code != http.StatusOK {
+		t.Errorf("expected response code %d for another IP, received %d", http.StatusOK, rr.Code)
+	}
+
+	close(ms.DataChannel)
+	wg.Wait()
+
+	if rr := request("/", "192.0.2.1:1003"); rr.Code != http.StatusOK {
+		t.Errorf("expected response code %d after disconnecting, received %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestSubscriberWriteTimeout(t *testing.T) {
+	timeoutLogger, hook := test.NewNullLogger()
+	ms := mock.NewMockSourceService()
+	ms.DataChannel = make(chan []byte)
+	caster := ntrip.NewCaster("N/A", ms, timeoutLogger)
+	caster.SubscriberWriteTimeout = 50 * time.Millisecond
+
+	server := httptest.NewUnstartedServer(caster.Handler)
+	server.Config.ConnContext = caster.ConnContext
+	server.Start()
+	defer server.Close()
+
+	// Publish until the handler stops accepting data, which it only does once a write times out
+	// after the socket buffers fill up
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for {
+			select {
+			case ms.DataChannel <- chunk:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Subscriber which never reads the response
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to caster: %s", err)
+	}
+	defer conn.Close()
+
+	req, _ := ntrip.NewClientRequest(server.URL + mock.MountPath)
+	req.SetBasicAuth(mock.Username, mock.Password)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("error writing request: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "connection closed with reason") {
+				if !strings.Contains(entry.Message, "timeout") {
+					t.Fatalf("expected write timeout, received %q", entry.Message)
+				}
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("subscriber not disconnected after write timeout")
+}
+
+func TestPublisherResponseHeaders(t *testing.T) {
+	caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), logger)
+	server := httptest.NewServer(caster.Handler)
+	defer server.Close()
+
+	// The response must be received while the request body is still open
+	r, w := io.Pipe()
+	defer w.Close()
+	req, _ := ntrip.NewServerRequest(server.URL+mock.MountPath, r)
+	req.SetBasicAuth(mock.Username, mock.Password)
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("error publishing: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected response status code %d, received %d", http.StatusOK, resp.StatusCode)
+	}
+	if v := resp.Header.Get(ntrip.NTRIPVersionHeaderKey); v != ntrip.NTRIPVersionHeaderValueV2 {
+		t.Errorf("expected %s header %q, received %q", ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2, v)
+	}
+	if !resp.Close {
+		t.Errorf("expected Connection: close header, received %q", resp.Header.Get("Connection"))
+	}
+
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Errorf("error writing data after response: %s", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package backoff provides exponentially increasing delays, with jitter, for reconnecting to
+// casters
+package backoff
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff doubles the delay returned by Next from Initial up to Max, each delay is randomised
+// between half and all of its value so clients disconnected at the same time don't reconnect
+// together - it's not safe for concurrent use
+type Backoff struct {
+	Initial  time.Duration
+	Max      time.Duration
+	attempts int
+	// rand is seeded per Backoff because the global source isn't seeded by every Go version this
+	// module supports, which would give every process the same delays
+	rand *rand.Rand
+}
+
+// New returns a Backoff starting at initial and capped at max
+func New(initial, max time.Duration) *Backoff {
+	return &Backoff{Initial: initial, Max: max, rand: newRand()}
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// Next returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	delay := b.Initial
+	for i := 0; i < b.attempts && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	} else {
+		b.attempts++
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+	// Backoffs constructed without New are seeded on first use
+	if b.rand == nil {
+		b.rand = newRand()
+	}
+	return delay/2 + time.Duration(b.rand.Int63n(int64(delay/2)+1))
+}
+
+// Reset returns the delay to Initial, it should be called once a connection succeeds
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
+
+// Wait sleeps for the next delay, returning early with ctx's error if ctx is done first
+func (b *Backoff) Wait(ctx context.Context) error {
+	timer := time.NewTimer(b.Next())
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
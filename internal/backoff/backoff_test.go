@@ -0,0 +1,52 @@
+package backoff_test
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/ntrip/internal/backoff"
+)
+
+func TestNext(t *testing.T) {
+	b := backoff.New(time.Second, 10*time.Second)
+
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max *= time.Second
+		if delay := b.Next(); delay < max/2 || delay > max {
+			t.Errorf("attempt %d: expected delay between %s and %s, received %s", i, max/2, max, delay)
+		}
+	}
+
+	b.Reset()
+	if delay := b.Next(); delay < time.Second/2 || delay > time.Second {
+		t.Errorf("expected delay between %s and %s after reset, received %s", time.Second/2, time.Second, delay)
+	}
+}
+
+// Each process must have different delays, so the global source - which is unseeded on older Go
+// versions - mustn't be used
+func TestJitterSeeded(t *testing.T) {
+	delays := map[time.Duration]bool{}
+	for i := 0; i < 5; i++ {
+		rand.Seed(1)
+		delays[backoff.New(time.Minute, time.Hour).Next()] = true
+	}
+	if len(delays) == 1 {
+		t.Errorf("expected Backoffs to have different delays with the same global seed")
+	}
+}
+
+func TestWaitCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := backoff.New(time.Minute, time.Minute).Wait(ctx); err != context.Canceled {
+		t.Errorf("expected error %q, received %v", context.Canceled, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected Wait to return when context cancelled")
+	}
+}
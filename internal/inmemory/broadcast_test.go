@@ -0,0 +1,99 @@
+package inmemory
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// panicWriter panics on every Write
+type panicWriter struct {
+	io.WriteCloser
+}
+
+func (p *panicWriter) Write(data []byte) (int, error) {
+	panic("intentionally triggered panic")
+}
+
+func (p *panicWriter) Close() error {
+	return nil
+}
+
+func TestBroadcastPanic(t *testing.T) {
+	ss := NewSourceService(nil)
+
+	r, w := io.Pipe()
+	defer w.Close()
+	healthy := &subscriber{username: "healthy", writer: w}
+	m := &mountpoint{subscribers: []*subscriber{{username: "panic", writer: &panicWriter{}}, healthy}}
+
+	// Read asynchronously because pipe Writes block until read
+	received := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		br, _ := r.Read(buf)
+		received <- string(buf[:br])
+	}()
+
+	ss.broadcast(m, []byte("data"))
+
+	if data := <-received; data != "data" {
+		t.Errorf("expected healthy subscriber to receive %q, received %q", "data", data)
+	}
+
+	if len(m.subscribers) != 1 || m.subscribers[0] != healthy {
+		t.Errorf("expected panicking subscriber to be removed, subscribers: %v", m.subscribers)
+	}
+
+	// Would deadlock if broadcast didn't release the lock
+	ss.Lock()
+	ss.Unlock()
+}
+
+func TestBroadcastReapsStalledSubscriber(t *testing.T) {
+	ss := NewSourceService(nil)
+	ss.SubscriberWriteTimeout = 10 * time.Millisecond
+	ss.SubscriberMaxTimeouts = 2
+
+	healthyData := make(chan []byte, subscriberBufferSize)
+	stalledData := make(chan []byte, subscriberBufferSize)
+	healthy := &subscriber{username: "healthy", writer: newChanWriter(healthyData, ss.SubscriberWriteTimeout)}
+	stalled := &subscriber{username: "stalled", writer: newChanWriter(stalledData, ss.SubscriberWriteTimeout)}
+	m := &mountpoint{subscribers: []*subscriber{healthy, stalled}}
+
+	received := make(chan int)
+	go func() {
+		count := 0
+		for range healthyData {
+			count++
+		}
+		received <- count
+	}()
+
+	// The stalled subscriber never reads, so once its buffer is full each write times out - up to
+	// SubscriberMaxTimeouts timeouts are tolerated
+	writes := subscriberBufferSize + ss.SubscriberMaxTimeouts
+	for i := 0; i < writes; i++ {
+		ss.broadcast(m, []byte("data"))
+	}
+
+	if len(m.subscribers) != 2 {
+		t.Fatalf("expected stalled subscriber to be tolerated, subscribers: %v", m.subscribers)
+	}
+
+	ss.broadcast(m, []byte("data"))
+	writes++
+
+	if len(m.subscribers) != 1 || m.subscribers[0] != healthy {
+		t.Fatalf("expected stalled subscriber to be removed, subscribers: %v", m.subscribers)
+	}
+
+	if _, ok := <-stalledData; !ok {
+		t.Errorf("expected stalled subscriber's buffered data to remain readable")
+	}
+
+	healthy.writer.Close()
+	if count := <-received; count != writes {
+		t.Errorf("expected healthy subscriber to receive %d writes, received %d", writes, count)
+	}
+}
@@ -0,0 +1,17 @@
+package inmemory
+
+// MountCoordinator is consulted before accepting a publisher, allowing an external service (such
+// as a database row lock or etcd) to ensure a mount is only published to on one of multiple
+// Caster instances
+type MountCoordinator interface {
+	// Acquire returns false if the mount is owned by another instance, otherwise release is
+	// called once the publisher disconnects
+	Acquire(mount string) (acquired bool, release func())
+}
+
+// NoopCoordinator acquires every mount, it's the default for a single Caster instance
+type NoopCoordinator struct{}
+
+func (NoopCoordinator) Acquire(mount string) (bool, func()) {
+	return true, func() {}
+}
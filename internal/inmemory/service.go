@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-gnss/ntrip"
 )
@@ -12,21 +14,219 @@ import (
 // SourceService is a simple in-memory implementation of ntrip.SourceService
 type SourceService struct {
 	sync.Mutex
-	Sourcetable ntrip.Sourcetable
-	mounts      map[string][]io.Writer
+	// sourcetable is updated using UpdateSourcetable or the Add and Remove entry methods,
+	// sourcetableLock is separate to the service lock so sourcetable requests aren't held up by
+	// writes to subscribers - it also guards maintenance, which affects the sourcetable
+	sourcetable     ntrip.Sourcetable
+	maintenance     map[string]bool
+	sourcetableLock sync.RWMutex
+	// Coordinator is consulted before accepting publishers, NewSourceService sets this to a
+	// NoopCoordinator
+	Coordinator MountCoordinator
+	mounts      map[string]*mountpoint
 	auth        Authoriser
+	// userConnections counts each user's active subscribers, for MaxConnectionsPerUser
+	userConnections map[string]int
+
+	// NTRIP sourcetables have no status field, so by convention mounts under maintenance are
+	// listed with MaintenanceMarker appended to their Misc field (defaults to "MAINTENANCE"), or
+	// are left out of the sourcetable if HideMaintenance is set - an empty marker lists them
+	// unchanged
+	MaintenanceMarker string
+	HideMaintenance   bool
+
+	// Subscribers which don't read data within SubscriberWriteTimeout more than
+	// SubscriberMaxTimeouts times within SubscriberTimeoutWindow are disconnected, so a client
+	// which never reads can't hold up the publisher - a single slow write is tolerated
+	SubscriberWriteTimeout  time.Duration
+	SubscriberMaxTimeouts   int
+	SubscriberTimeoutWindow time.Duration
+
+	// MaxConnectionsPerUser limits the number of subscriptions a user can have at once, counting
+	// each connection separately even if they're to the same mount - new subscriptions beyond the
+	// limit receive ntrip.ErrorTooManyConnections, zero disables the limit
+	MaxConnectionsPerUser int
+}
+
+// mountpoint is an online mount, the publisher's data is read from reader and written to each of
+// the subscribers - closing reader or a subscriber's writer disconnects the respective client
+type mountpoint struct {
+	username    string
+	info        PublisherInfo
+	reader      *io.PipeReader
+	subscribers []*subscriber
+	// release is returned by the Coordinator and is set to nil once called
+	release func()
+}
+
+// PublisherInfo describes the publisher connected to a mount
+type PublisherInfo struct {
+	Username   string
+	RemoteAddr string
+	Connected  time.Time
+	// Format is taken from the mount's sourcetable entry, and is empty if the mount isn't listed
+	Format string
 }
 
 func NewSourceService(auth Authoriser) *SourceService {
+	return NewSourceServiceWithTable(ntrip.Sourcetable{}, auth)
+}
+
+// NewSourceServiceWithTable constructs a SourceService with an initial Sourcetable
+func NewSourceServiceWithTable(st ntrip.Sourcetable, auth Authoriser) *SourceService {
 	return &SourceService{
-		mounts: map[string][]io.Writer{},
-		auth:   auth,
+		sourcetable: st,
+		Coordinator: NoopCoordinator{},
+		mounts:      map[string]*mountpoint{},
+		maintenance: map[string]bool{},
+		auth:        auth,
+
+		userConnections: map[string]int{},
+
+		MaintenanceMarker: "MAINTENANCE",
+
+		SubscriberWriteTimeout:  500 * time.Millisecond,
+		SubscriberMaxTimeouts:   3,
+		SubscriberTimeoutWindow: 1 * time.Minute,
 	}
 }
 
 func (ss *SourceService) GetSourcetable() ntrip.Sourcetable {
+	ss.sourcetableLock.RLock()
+	defer ss.sourcetableLock.RUnlock()
 	// TODO: Only include online Mounts in output
-	return ss.Sourcetable
+	if len(ss.maintenance) == 0 {
+		return ss.sourcetable
+	}
+
+	st := ss.sourcetable
+	st.Mounts = make([]ntrip.StreamEntry, 0, len(ss.sourcetable.Mounts))
+	for _, m := range ss.sourcetable.Mounts {
+		if ss.maintenance[m.Name] {
+			if ss.HideMaintenance {
+				continue
+			}
+			if ss.MaintenanceMarker != "" {
+				m.Misc = strings.TrimSpace(m.Misc + " " + ss.MaintenanceMarker)
+			}
+		}
+		st.Mounts = append(st.Mounts, m)
+	}
+	return st
+}
+
+// UpdateSourcetable replaces the Sourcetable returned by GetSourcetable
+func (ss *SourceService) UpdateSourcetable(st ntrip.Sourcetable) {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+	ss.sourcetable = st
+}
+
+// The entry methods replace the Sourcetable's slices rather than modifying them, so Sourcetables
+// previously returned by GetSourcetable are unaffected
+
+// AddMountEntry adds entry to the Sourcetable, replacing any existing entry with the same Name
+func (ss *SourceService) AddMountEntry(entry ntrip.StreamEntry) {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	mounts := make([]ntrip.StreamEntry, 0, len(ss.sourcetable.Mounts)+1)
+	for _, m := range ss.sourcetable.Mounts {
+		if m.Name != entry.Name {
+			mounts = append(mounts, m)
+		}
+	}
+	ss.sourcetable.Mounts = append(mounts, entry)
+}
+
+// RemoveMountEntry removes the entry with the given Name from the Sourcetable, returning
+// ntrip.ErrorNotFound if there is no such entry
+func (ss *SourceService) RemoveMountEntry(name string) error {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	mounts := make([]ntrip.StreamEntry, 0, len(ss.sourcetable.Mounts))
+	for _, m := range ss.sourcetable.Mounts {
+		if m.Name != name {
+			mounts = append(mounts, m)
+		}
+	}
+
+	if len(mounts) == len(ss.sourcetable.Mounts) {
+		return ntrip.ErrorNotFound
+	}
+	ss.sourcetable.Mounts = mounts
+	return nil
+}
+
+// AddCasterEntry adds entry to the Sourcetable, replacing any existing entry with the same Host
+// and Port
+func (ss *SourceService) AddCasterEntry(entry ntrip.CasterEntry) {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	casters := make([]ntrip.CasterEntry, 0, len(ss.sourcetable.Casters)+1)
+	for _, c := range ss.sourcetable.Casters {
+		if c.Host != entry.Host || c.Port != entry.Port {
+			casters = append(casters, c)
+		}
+	}
+	ss.sourcetable.Casters = append(casters, entry)
+}
+
+// RemoveCasterEntry removes the entry with the given Host and Port from the Sourcetable,
+// returning ntrip.ErrorNotFound if there is no such entry
+func (ss *SourceService) RemoveCasterEntry(host string, port int) error {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	casters := make([]ntrip.CasterEntry, 0, len(ss.sourcetable.Casters))
+	for _, c := range ss.sourcetable.Casters {
+		if c.Host != host || c.Port != port {
+			casters = append(casters, c)
+		}
+	}
+
+	if len(casters) == len(ss.sourcetable.Casters) {
+		return ntrip.ErrorNotFound
+	}
+	ss.sourcetable.Casters = casters
+	return nil
+}
+
+// AddNetworkEntry adds entry to the Sourcetable, replacing any existing entry with the same
+// Identifier
+func (ss *SourceService) AddNetworkEntry(entry ntrip.NetworkEntry) {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	networks := make([]ntrip.NetworkEntry, 0, len(ss.sourcetable.Networks)+1)
+	for _, n := range ss.sourcetable.Networks {
+		if n.Identifier != entry.Identifier {
+			networks = append(networks, n)
+		}
+	}
+	ss.sourcetable.Networks = append(networks, entry)
+}
+
+// RemoveNetworkEntry removes the entry with the given Identifier from the Sourcetable, returning
+// ntrip.ErrorNotFound if there is no such entry
+func (ss *SourceService) RemoveNetworkEntry(identifier string) error {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	networks := make([]ntrip.NetworkEntry, 0, len(ss.sourcetable.Networks))
+	for _, n := range ss.sourcetable.Networks {
+		if n.Identifier != identifier {
+			networks = append(networks, n)
+		}
+	}
+
+	if len(networks) == len(ss.sourcetable.Networks) {
+		return ntrip.ErrorNotFound
+	}
+	ss.sourcetable.Networks = networks
+	return nil
 }
 
 func (ss *SourceService) Publisher(ctx context.Context, mount, username, password string) (io.WriteCloser, error) {
@@ -36,20 +236,33 @@ func (ss *SourceService) Publisher(ctx context.Context, mount, username, passwor
 		return nil, ntrip.ErrorNotAuthorized
 	}
 
+	// Acquired before taking the lock because the Coordinator may need to make network requests
+	acquired, release := ss.Coordinator.Acquire(mount)
+	if !acquired {
+		return nil, ntrip.ErrorConflict
+	}
+
 	ss.Lock()
 	defer ss.Unlock()
 
 	_, ok := ss.mounts[mount]
 	if ok {
+		release()
 		return nil, ntrip.ErrorConflict
 	}
 
-	// Subscribers register themselves by adding their writer to this slice
-	ss.mounts[mount] = []io.Writer{}
-
 	r, w := io.Pipe()
 
-	// TODO: Read from r, and write to ss.mounts[mount]
+	// Subscribers register themselves by adding their writer to m.subscribers
+	m := &mountpoint{username: username, reader: r, release: release}
+	m.info = PublisherInfo{
+		Username:   username,
+		RemoteAddr: ntrip.RemoteAddr(ctx),
+		Connected:  time.Now(),
+		Format:     ss.mountFormat(mount),
+	}
+	ss.mounts[mount] = m
+
 	go func() {
 		for {
 			// Read
@@ -57,18 +270,13 @@ func (ss *SourceService) Publisher(ctx context.Context, mount, username, passwor
 			br, err := r.Read(buf)
 			if err != nil {
 				// Remove self from mounts map if Reader closes
-				delete(ss.mounts, mount)
+				ss.Lock()
+				ss.removeMount(mount, m)
+				ss.Unlock()
 				return
 			}
 			// Write
-			ss.Lock()
-			for i, w := range ss.mounts[mount] {
-				if _, err := w.Write(buf[:br]); err != nil {
-					// Re-slice to remove closed Writer
-					ss.mounts[mount] = append(ss.mounts[mount][:i], ss.mounts[mount][i+1:]...)
-				}
-			}
-			ss.Unlock()
+			ss.broadcast(m, buf[:br])
 		}
 	}()
 
@@ -85,33 +293,187 @@ func (ss *SourceService) Subscriber(ctx context.Context, mount, username, passwo
 	ss.Lock()
 	defer ss.Unlock()
 
-	mw, ok := ss.mounts[mount]
+	// Checked before the mount is looked up, so clients are told to retry while a mount under
+	// maintenance is offline
+	ss.sourcetableLock.RLock()
+	maintenance := ss.maintenance[mount]
+	ss.sourcetableLock.RUnlock()
+	if maintenance {
+		return nil, ntrip.ErrorUnavailable
+	}
+
+	m, ok := ss.mounts[mount]
 	if !ok {
 		return nil, ntrip.ErrorNotFound
 	}
 
-	r, w := io.Pipe()
-	ss.mounts[mount] = append(mw, w)
+	if ss.MaxConnectionsPerUser > 0 && ss.userConnections[username] >= ss.MaxConnectionsPerUser {
+		return nil, ntrip.ErrorTooManyConnections
+	}
 
-	// Cleanup when client closes connection
+	data := make(chan []byte, subscriberBufferSize)
+	writer := newChanWriter(data, ss.SubscriberWriteTimeout)
+	// The writer is only closed while holding the lock, so the count can be decremented in onClose
+	// however the subscriber is disconnected
+	ss.userConnections[username]++
+	writer.onClose = func() {
+		if ss.userConnections[username]--; ss.userConnections[username] == 0 {
+			delete(ss.userConnections, username)
+		}
+	}
+
+	s := &subscriber{username: username, writer: writer}
+	m.subscribers = append(m.subscribers, s)
+
+	// Cleanup when client closes connection, the writer is only written to and closed while
+	// holding the lock
 	go func() {
 		<-ctx.Done()
-		w.Close()
+		ss.Lock()
+		defer ss.Unlock()
+		// Closing the channel signals to the caster that the connection should be closed
+		s.writer.Close()
 	}()
 
-	data := make(chan []byte, 1)
-	// Read from r and write to data channel
-	go func() {
-		for {
-			buf := make([]byte, 1024)
-			br, err := r.Read(buf)
-			if err != nil {
-				// Server closed connection
-				return
+	return data, nil
+}
+
+// Writes data to each of m's subscribers, removing those which fail - a subscriber panicking must
+// not leave the service locked, or every mount would be blocked. Writes are made without holding
+// the lock so a subscriber which isn't reading only holds up its own mount, broadcast is only
+// called from the mount's publisher goroutine so writes to a subscriber are never concurrent.
+func (ss *SourceService) broadcast(m *mountpoint, data []byte) {
+	ss.Lock()
+	subscribers := append([]*subscriber(nil), m.subscribers...)
+	ss.Unlock()
+
+	now := time.Now()
+	failed := map[*subscriber]bool{}
+	for _, s := range subscribers {
+		err := s.write(data)
+		if err == errWriteTimeout && !s.timedOut(now, ss.SubscriberMaxTimeouts, ss.SubscriberTimeoutWindow) {
+			err = nil
+		}
+
+		if err != nil {
+			failed[s] = true
+		}
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	// Subscribers may have been added or removed while writing, so filter the current list
+	remaining := m.subscribers[:0]
+	for _, s := range m.subscribers {
+		if failed[s] {
+			s.writer.Close()
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+	m.subscribers = remaining
+}
+
+// MountPublisher returns information about the publisher currently connected to mount, ok is false
+// if the mount has no publisher
+func (ss *SourceService) MountPublisher(mount string) (info PublisherInfo, ok bool) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	m, ok := ss.mounts[mount]
+	if !ok {
+		return PublisherInfo{}, false
+	}
+	return m.info, true
+}
+
+// Returns the format declared in mount's sourcetable entry
+func (ss *SourceService) mountFormat(mount string) string {
+	ss.sourcetableLock.RLock()
+	defer ss.sourcetableLock.RUnlock()
+
+	m, _ := ss.sourcetable.Mount(mount)
+	return m.Format
+}
+
+// SetMaintenance marks a mount as being under maintenance, while set new subscribers will receive
+// ntrip.ErrorUnavailable but publishers can still connect
+func (ss *SourceService) SetMaintenance(mount string, maintenance bool) {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	if maintenance {
+		ss.maintenance[mount] = true
+	} else {
+		delete(ss.maintenance, mount)
+	}
+}
+
+// Disconnect closes the publisher and all subscribers connected to mount
+func (ss *SourceService) Disconnect(mount string) error {
+	ss.Lock()
+	defer ss.Unlock()
+
+	m, ok := ss.mounts[mount]
+	if !ok {
+		return ntrip.ErrorNotFound
+	}
+
+	ss.removeMount(mount, m)
+	return nil
+}
+
+// DisconnectUser closes all publishers and subscribers connected with username
+func (ss *SourceService) DisconnectUser(username string) error {
+	ss.Lock()
+	defer ss.Unlock()
+
+	found := false
+	for name, m := range ss.mounts {
+		if m.username == username {
+			ss.removeMount(name, m)
+			found = true
+			continue
+		}
+
+		subscribers := m.subscribers[:0]
+		for _, s := range m.subscribers {
+			if s.username == username {
+				s.writer.Close()
+				found = true
+				continue
 			}
-			data <- buf[:br]
+			subscribers = append(subscribers, s)
 		}
-	}()
+		m.subscribers = subscribers
+	}
 
-	return data, nil
+	if !found {
+		return ntrip.ErrorNotFound
+	}
+	return nil
+}
+
+// Closes the publisher and subscribers of m, removing it from the mounts map if it has not already
+// been replaced by a new publisher - must be called while holding the lock
+func (ss *SourceService) removeMount(mount string, m *mountpoint) {
+	if ss.mounts[mount] == m {
+		delete(ss.mounts, mount)
+	}
+
+	m.reader.Close()
+	for _, s := range m.subscribers {
+		s.writer.Close()
+	}
+	m.subscribers = nil
+
+	if m.release != nil {
+		m.release()
+		m.release = nil
+	}
 }
@@ -1,9 +1,11 @@
 package inmemory_test
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,6 +28,183 @@ func (_ *auth) Authorise(action inmemory.Action, mount string, username string,
 	return true, nil
 }
 
+// allowAll authorises any request, for tests which need multiple users
+type allowAll struct{}
+
+func (_ *allowAll) Authorise(action inmemory.Action, mount string, username string, password string) (authorised bool, err error) {
+	return true, nil
+}
+
+// Fails the test if c isn't closed within a second, discarding any data remaining in the channel
+func expectClosed(t *testing.T, c chan []byte) {
+	t.Helper()
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for subscriber channel to close")
+		}
+	}
+}
+
+// Fails the test if data isn't read from c within a second
+func expectData(t *testing.T, c chan []byte, data string) {
+	t.Helper()
+	select {
+	case d, ok := <-c:
+		if !ok {
+			t.Fatalf("subscriber channel closed unexpectedly")
+		}
+		if string(d) != data {
+			t.Fatalf("expected data %q, received %q", data, string(d))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for data")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ss := inmemory.NewSourceService(&allowAll{})
+	pub, err := ss.Publisher(ctx, "TEST00AUS0", "publisher", "")
+	if err != nil {
+		t.Fatalf("error creating publisher: %s", err)
+	}
+	sub, err := ss.Subscriber(ctx, "TEST00AUS0", "subscriber", "")
+	if err != nil {
+		t.Fatalf("error creating subscriber: %s", err)
+	}
+
+	pub.Write([]byte("before disconnect"))
+	expectData(t, sub, "before disconnect")
+
+	if err := ss.Disconnect("TEST00AUS0"); err != nil {
+		t.Fatalf("error disconnecting mount: %s", err)
+	}
+
+	expectClosed(t, sub)
+	if _, err := pub.Write([]byte("after disconnect")); err == nil {
+		t.Errorf("expected error writing to disconnected publisher")
+	}
+
+	if err := ss.Disconnect("TEST00AUS0"); err != ntrip.ErrorNotFound {
+		t.Errorf("expected error %q disconnecting offline mount, received %q", ntrip.ErrorNotFound, err)
+	}
+
+	// Mount should be available to publish to again
+	if _, err := ss.Publisher(ctx, "TEST00AUS0", "publisher", ""); err != nil {
+		t.Errorf("error reconnecting publisher: %s", err)
+	}
+}
+
+func TestDisconnectUser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ss := inmemory.NewSourceService(&allowAll{})
+	pub, _ := ss.Publisher(ctx, "TEST00AUS0", "publisher", "")
+	kicked, _ := ss.Subscriber(ctx, "TEST00AUS0", "kicked", "")
+	other, _ := ss.Subscriber(ctx, "TEST00AUS0", "other", "")
+
+	if err := ss.DisconnectUser("kicked"); err != nil {
+		t.Fatalf("error disconnecting user: %s", err)
+	}
+	expectClosed(t, kicked)
+
+	pub.Write([]byte("still connected"))
+	expectData(t, other, "still connected")
+
+	// Disconnecting the publisher's user should also close the mount's subscribers
+	if err := ss.DisconnectUser("publisher"); err != nil {
+		t.Fatalf("error disconnecting user: %s", err)
+	}
+	expectClosed(t, other)
+
+	if err := ss.DisconnectUser("nobody"); err != ntrip.ErrorNotFound {
+		t.Errorf("expected error %q disconnecting unknown user, received %q", ntrip.ErrorNotFound, err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ss := inmemory.NewSourceService(&allowAll{})
+	ss.SetMaintenance("TEST00AUS0", true)
+
+	if _, err := ss.Subscriber(ctx, "TEST00AUS0", "subscriber", ""); err != ntrip.ErrorUnavailable {
+		t.Errorf("expected error %q subscribing to offline maintenance mount, received %q", ntrip.ErrorUnavailable, err)
+	}
+
+	// Publishers can still connect to maintenance mounts
+	if _, err := ss.Publisher(ctx, "TEST00AUS0", "publisher", ""); err != nil {
+		t.Fatalf("error creating publisher: %s", err)
+	}
+
+	if _, err := ss.Subscriber(ctx, "TEST00AUS0", "subscriber", ""); err != ntrip.ErrorUnavailable {
+		t.Errorf("expected error %q subscribing to maintenance mount, received %q", ntrip.ErrorUnavailable, err)
+	}
+
+	ss.SetMaintenance("TEST00AUS0", false)
+	if _, err := ss.Subscriber(ctx, "TEST00AUS0", "subscriber", ""); err != nil {
+		t.Errorf("error subscribing after maintenance: %s", err)
+	}
+}
+
+// coordinator only allows each mount to be acquired once until released
+type coordinator struct {
+	sync.Mutex
+	acquired map[string]bool
+}
+
+func (c *coordinator) Acquire(mount string) (bool, func()) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.acquired[mount] {
+		return false, nil
+	}
+
+	c.acquired[mount] = true
+	return true, func() {
+		c.Lock()
+		defer c.Unlock()
+		delete(c.acquired, mount)
+	}
+}
+
+func TestMountCoordinator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two SourceServices sharing a coordinator, as if they were running on separate instances
+	c := &coordinator{acquired: map[string]bool{}}
+	first := inmemory.NewSourceService(&allowAll{})
+	first.Coordinator = c
+	second := inmemory.NewSourceService(&allowAll{})
+	second.Coordinator = c
+
+	if _, err := first.Publisher(ctx, "TEST00AUS0", "publisher", ""); err != nil {
+		t.Fatalf("error creating publisher: %s", err)
+	}
+
+	if _, err := second.Publisher(ctx, "TEST00AUS0", "publisher", ""); err != ntrip.ErrorConflict {
+		t.Fatalf("expected error %q publishing to mount acquired by another instance, received %q", ntrip.ErrorConflict, err)
+	}
+
+	// Mount is released when the first instance's publisher disconnects
+	first.Disconnect("TEST00AUS0")
+	if _, err := second.Publisher(ctx, "TEST00AUS0", "publisher", ""); err != nil {
+		t.Errorf("error publishing to released mount: %s", err)
+	}
+}
+
 // TODO: Actually write some tests for this, once I work out a direction for it
 func _TestInMemoryService(t *testing.T) {
 	caster := ntrip.NewCaster(":2101", inmemory.NewSourceService(&auth{}), logrus.StandardLogger())
@@ -51,3 +230,255 @@ func _TestInMemoryService(t *testing.T) {
 
 	caster.ListenAndServe()
 }
+
+func TestSourcetableEntries(t *testing.T) {
+	ss := inmemory.NewSourceService(&allowAll{})
+
+	ss.AddMountEntry(ntrip.StreamEntry{Name: "MOUNT1"})
+	ss.AddMountEntry(ntrip.StreamEntry{Name: "MOUNT2"})
+	ss.AddMountEntry(ntrip.StreamEntry{Name: "MOUNT1", Identifier: "replaced"})
+	ss.AddCasterEntry(ntrip.CasterEntry{Host: "host", Port: 2101})
+	ss.AddNetworkEntry(ntrip.NetworkEntry{Identifier: "NET"})
+
+	before := ss.GetSourcetable()
+	if len(before.Mounts) != 2 || before.Mounts[1].Identifier != "replaced" {
+		t.Fatalf("expected MOUNT1 to be replaced, received %+v", before.Mounts)
+	}
+
+	if err := ss.RemoveMountEntry("MOUNT2"); err != nil {
+		t.Errorf("error removing mount entry: %s", err)
+	}
+	if err := ss.RemoveMountEntry("MOUNT2"); err != ntrip.ErrorNotFound {
+		t.Errorf("expected error %s removing missing mount entry, received %v", ntrip.ErrorNotFound, err)
+	}
+	if err := ss.RemoveCasterEntry("host", 2101); err != nil {
+		t.Errorf("error removing caster entry: %s", err)
+	}
+	if err := ss.RemoveNetworkEntry("NET"); err != nil {
+		t.Errorf("error removing network entry: %s", err)
+	}
+
+	after := ss.GetSourcetable()
+	if len(after.Mounts) != 1 || len(after.Casters) != 0 || len(after.Networks) != 0 {
+		t.Errorf("unexpected sourcetable after removing entries: %+v", after)
+	}
+
+	// Previously returned sourcetables must not be modified
+	if len(before.Mounts) != 2 || before.Mounts[0].Name != "MOUNT2" {
+		t.Errorf("previously returned sourcetable was modified: %+v", before.Mounts)
+	}
+}
+
+func TestSourcetableEntriesConcurrent(t *testing.T) {
+	ss := inmemory.NewSourceService(&allowAll{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint(i)
+			ss.AddMountEntry(ntrip.StreamEntry{Name: name})
+			ss.AddCasterEntry(ntrip.CasterEntry{Host: name})
+			ss.AddNetworkEntry(ntrip.NetworkEntry{Identifier: name})
+			_ = ss.GetSourcetable().String()
+			if i%2 == 0 {
+				ss.RemoveMountEntry(name)
+				ss.RemoveCasterEntry(name, 0)
+				ss.RemoveNetworkEntry(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	st := ss.GetSourcetable()
+	if len(st.Mounts) != 25 || len(st.Casters) != 25 || len(st.Networks) != 25 {
+		t.Errorf("expected 25 of each entry, received %d mounts, %d casters and %d networks",
+			len(st.Mounts), len(st.Casters), len(st.Networks))
+	}
+}
+
+func TestSourcetableWithTable(t *testing.T) {
+	initial := ntrip.Sourcetable{Mounts: []ntrip.StreamEntry{{Name: "INITIAL"}}}
+	ss := inmemory.NewSourceServiceWithTable(initial, &allowAll{})
+
+	if st := ss.GetSourcetable(); len(st.Mounts) != 1 || st.Mounts[0].Name != "INITIAL" {
+		t.Fatalf("expected initial sourcetable, received %+v", st)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ss.UpdateSourcetable(ntrip.Sourcetable{Mounts: []ntrip.StreamEntry{{Name: fmt.Sprint(i)}}})
+			_ = ss.GetSourcetable().String()
+		}(i)
+	}
+	wg.Wait()
+
+	ss.UpdateSourcetable(ntrip.Sourcetable{Mounts: []ntrip.StreamEntry{{Name: "UPDATED"}}})
+	if st := ss.GetSourcetable(); len(st.Mounts) != 1 || st.Mounts[0].Name != "UPDATED" {
+		t.Errorf("expected updated sourcetable, received %+v", st)
+	}
+}
+
+func TestMaintenanceSourcetable(t *testing.T) {
+	ss := inmemory.NewSourceServiceWithTable(ntrip.Sourcetable{
+		Mounts: []ntrip.StreamEntry{{Name: "ONLINE", Misc: "misc"}, {Name: "DOWN", Misc: "misc"}, {Name: "NOMISC"}},
+	}, &allowAll{})
+	ss.SetMaintenance("DOWN", true)
+	ss.SetMaintenance("NOMISC", true)
+
+	st := ss.GetSourcetable()
+	if len(st.Mounts) != 3 || st.Mounts[0].Misc != "misc" || st.Mounts[1].Misc != "misc MAINTENANCE" || st.Mounts[2].Misc != "MAINTENANCE" {
+		t.Errorf("expected maintenance mounts to be marked, received %+v", st.Mounts)
+	}
+
+	ss.MaintenanceMarker = "[offline]"
+	if st := ss.GetSourcetable(); st.Mounts[1].Misc != "misc [offline]" {
+		t.Errorf("expected custom maintenance marker, received %q", st.Mounts[1].Misc)
+	}
+
+	ss.HideMaintenance = true
+	if st := ss.GetSourcetable(); len(st.Mounts) != 1 || st.Mounts[0].Name != "ONLINE" {
+		t.Errorf("expected maintenance mounts to be hidden, received %+v", st.Mounts)
+	}
+
+	ss.SetMaintenance("DOWN", false)
+	ss.SetMaintenance("NOMISC", false)
+	if st := ss.GetSourcetable(); len(st.Mounts) != 3 || st.Mounts[1].Misc != "misc" {
+		t.Errorf("expected unmarked sourcetable after maintenance, received %+v", st.Mounts)
+	}
+}
+
+func TestMountPublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ss := inmemory.NewSourceServiceWithTable(ntrip.Sourcetable{
+		Mounts: []ntrip.StreamEntry{{Name: "TEST00AUS0", Format: "RTCM 3.2"}},
+	}, &allowAll{})
+
+	if _, ok := ss.MountPublisher("TEST00AUS0"); ok {
+		t.Errorf("expected no publisher info for offline mount")
+	}
+
+	before := time.Now()
+	pubCtx := context.WithValue(ctx, ntrip.RemoteAddrContextKey, "192.0.2.1:54321")
+	if _, err := ss.Publisher(pubCtx, "TEST00AUS0", "publisher", ""); err != nil {
+		t.Fatalf("error creating publisher: %s", err)
+	}
+
+	info, ok := ss.MountPublisher("TEST00AUS0")
+	if !ok {
+		t.Fatalf("expected publisher info for online mount")
+	}
+	if info.Username != "publisher" || info.RemoteAddr != "192.0.2.1:54321" || info.Format != "RTCM 3.2" {
+		t.Errorf("unexpected publisher info %+v", info)
+	}
+	if info.Connected.Before(before) || info.Connected.After(time.Now()) {
+		t.Errorf("unexpected connect time %s", info.Connected)
+	}
+
+	// Mounts missing from the sourcetable have no declared format
+	if _, err := ss.Publisher(ctx, "UNLISTED", "publisher", ""); err != nil {
+		t.Fatalf("error creating publisher: %s", err)
+	}
+	if info, _ := ss.MountPublisher("UNLISTED"); info.Format != "" || info.RemoteAddr != "" {
+		t.Errorf("unexpected publisher info %+v", info)
+	}
+
+	ss.Disconnect("TEST00AUS0")
+	if _, ok := ss.MountPublisher("TEST00AUS0"); ok {
+		t.Errorf("expected no publisher info after disconnect")
+	}
+}
+
+func TestMaxConnectionsPerUser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ss := inmemory.NewSourceService(&allowAll{})
+	ss.MaxConnectionsPerUser = 2
+	pub, _ := ss.Publisher(ctx, "TEST00AUS0", "publisher", "")
+
+	firstCtx, firstCancel := context.WithCancel(ctx)
+	first, err := ss.Subscriber(firstCtx, "TEST00AUS0", "user", "")
+	if err != nil {
+		t.Fatalf("error creating first subscriber: %s", err)
+	}
+	if _, err := ss.Subscriber(ctx, "TEST00AUS0", "user", ""); err != nil {
+		t.Fatalf("error creating second subscriber: %s", err)
+	}
+
+	if _, err := ss.Subscriber(ctx, "TEST00AUS0", "user", ""); err != ntrip.ErrorTooManyConnections {
+		t.Errorf("expected error %q for third subscriber, received %v", ntrip.ErrorTooManyConnections, err)
+	}
+	if _, err := ss.Subscriber(ctx, "TEST00AUS0", "other", ""); err != nil {
+		t.Errorf("error creating subscriber for other user: %s", err)
+	}
+
+	// Closing a subscriber frees up a connection
+	firstCancel()
+	expectClosed(t, first)
+	sub, err := ss.Subscriber(ctx, "TEST00AUS0", "user", "")
+	if err != nil {
+		t.Fatalf("error creating subscriber after disconnect: %s", err)
+	}
+
+	// As does the mount's publisher disconnecting
+	pub.Close()
+	expectClosed(t, sub)
+	pub, _ = ss.Publisher(ctx, "TEST00AUS0", "publisher", "")
+	defer pub.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := ss.Subscriber(ctx, "TEST00AUS0", "user", ""); err != nil {
+			t.Errorf("error creating subscriber after publisher disconnect: %s", err)
+		}
+	}
+}
+
+func TestStalledSubscriberDoesNotBlockOtherMounts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ss := inmemory.NewSourceService(&allowAll{})
+	ss.SubscriberWriteTimeout = 500 * time.Millisecond
+	ss.SubscriberMaxTimeouts = 100
+
+	stalledPub, _ := ss.Publisher(ctx, "STALLED", "publisher", "")
+	defer stalledPub.Close()
+	if _, err := ss.Subscriber(ctx, "STALLED", "stalled", ""); err != nil {
+		t.Fatalf("error creating stalled subscriber: %s", err)
+	}
+
+	// The stalled subscriber never reads, so once its buffer is full every write to the mount
+	// waits for SubscriberWriteTimeout
+	go func() {
+		for ctx.Err() == nil {
+			if _, err := stalledPub.Write([]byte("stalled")); err != nil {
+				return
+			}
+		}
+	}()
+
+	pub, _ := ss.Publisher(ctx, "HEALTHY", "publisher", "")
+	defer pub.Close()
+	sub, err := ss.Subscriber(ctx, "HEALTHY", "healthy", "")
+	if err != nil {
+		t.Fatalf("error creating healthy subscriber: %s", err)
+	}
+
+	// Give the stalled mount time to fill its subscriber's buffer
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		pub.Write([]byte("data"))
+		expectData(t, sub, "data")
+	}
+	if elapsed := time.Since(start); elapsed >= ss.SubscriberWriteTimeout {
+		t.Errorf("expected writes to healthy mount to be unaffected by stalled mount, took %s", elapsed)
+	}
+}
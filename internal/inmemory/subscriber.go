@@ -0,0 +1,115 @@
+package inmemory
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Number of writes buffered for each subscriber, giving clients some leeway before writes time out
+const subscriberBufferSize = 16
+
+var errWriteTimeout = fmt.Errorf("timeout writing to subscriber")
+
+type subscriber struct {
+	username string
+	writer   io.WriteCloser
+	// Times at which writes to writer have timed out, within the timeout window
+	timeouts []time.Time
+}
+
+// Recovers from the subscriber's writer panicking, returning the panic as an error
+func (s *subscriber) write(data []byte) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic writing to subscriber: %v", p)
+		}
+	}()
+
+	_, err = s.writer.Write(data)
+	return err
+}
+
+// Records a write timeout at now, returning true if more than max timeouts have occurred within
+// window - which indicates the subscriber isn't reading, rather than being briefly slow
+func (s *subscriber) timedOut(now time.Time, max int, window time.Duration) bool {
+	timeouts := s.timeouts[:0]
+	for _, t := range s.timeouts {
+		if now.Sub(t) < window {
+			timeouts = append(timeouts, t)
+		}
+	}
+	s.timeouts = append(timeouts, now)
+	return len(s.timeouts) > max
+}
+
+// chanWriter writes to a subscriber's data channel, returning errWriteTimeout if the channel's
+// buffer is full for longer than timeout - it's written to by the mount's broadcast goroutine
+// without holding the SourceService lock, so a slow subscriber only holds up its own mount
+type chanWriter struct {
+	c       chan []byte
+	timeout time.Duration
+	// mu is held while sending on c, so c isn't closed during a send - done is closed first so a
+	// blocked send returns promptly
+	mu   sync.Mutex
+	done chan struct{}
+	once sync.Once
+	// onClose is called, if set, the first time the writer is closed
+	onClose func()
+}
+
+func newChanWriter(c chan []byte, timeout time.Duration) *chanWriter {
+	return &chanWriter{c: c, timeout: timeout, done: make(chan struct{})}
+}
+
+func (cw *chanWriter) Write(data []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if cw.closed() {
+		return 0, io.ErrClosedPipe
+	}
+
+	select {
+	case cw.c <- data:
+		return len(data), nil
+	default:
+	}
+
+	timer := time.NewTimer(cw.timeout)
+	defer timer.Stop()
+
+	select {
+	case cw.c <- data:
+		return len(data), nil
+	case <-cw.done:
+		return 0, io.ErrClosedPipe
+	case <-timer.C:
+		return 0, errWriteTimeout
+	}
+}
+
+// Close closes the data channel, it's safe to call more than once but must be called while holding
+// the SourceService lock since onClose modifies the service
+func (cw *chanWriter) Close() error {
+	cw.once.Do(func() {
+		close(cw.done)
+		cw.mu.Lock()
+		close(cw.c)
+		cw.mu.Unlock()
+		if cw.onClose != nil {
+			cw.onClose()
+		}
+	})
+	return nil
+}
+
+func (cw *chanWriter) closed() bool {
+	select {
+	case <-cw.done:
+		return true
+	default:
+		return false
+	}
+}
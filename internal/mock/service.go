@@ -22,6 +22,8 @@ var ()
 type MockSourceService struct {
 	DataChannel chan []byte
 	Sourcetable ntrip.Sourcetable
+	// Maintenance causes Subscriber to return ntrip.ErrorUnavailable
+	Maintenance bool
 }
 
 func NewMockSourceService() *MockSourceService {
@@ -54,6 +56,10 @@ func (m *MockSourceService) Subscriber(ctx context.Context, mount, username, pas
 		return nil, ntrip.ErrorNotFound
 	}
 
+	if m.Maintenance {
+		return nil, ntrip.ErrorUnavailable
+	}
+
 	if m.DataChannel == nil {
 		return nil, ntrip.ErrorNotFound
 	}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gnss/ntrip"
+)
+
+// Number of reads buffered for each subscriber, subscribers which fall further behind than this
+// are disconnected so they can't hold up the upstream connection
+const subscriberBufferSize = 16
+
+// SourceService is an ntrip.SourceService which relays mounts from an upstream caster, sharing a
+// single upstream connection between all subscribers to a mount - publishing is not supported
+type SourceService struct {
+	sync.Mutex
+	// Upstream is the URL of the upstream caster, for example "http://caster.example.com:2101"
+	Upstream string
+	// Username and Password are used for all requests to the upstream caster, subscribers to the
+	// SourceService are not authenticated
+	Username string
+	Password string
+	Client   *http.Client
+	// ReconnectInterval is the time waited before reconnecting to the upstream caster after the
+	// connection for a mount fails, the mount is closed if the upstream responds with 401 or 404
+	ReconnectInterval time.Duration
+	mounts            map[string]*relay
+
+	// SourcetableTTL is how long the upstream sourcetable is cached for
+	SourcetableTTL time.Duration
+	// sourcetableLock is held while fetching the sourcetable, so concurrent requests for an
+	// expired sourcetable only fetch it once
+	sourcetableLock    sync.Mutex
+	sourcetable        ntrip.Sourcetable
+	sourcetableExpires time.Time
+}
+
+// relay is an upstream connection for a mount, data read from the upstream is written to each of
+// the subscribers - closing a subscriber's channel disconnects the client
+type relay struct {
+	subscribers map[chan []byte]struct{}
+	// cancel closes the upstream connection
+	cancel context.CancelFunc
+}
+
+func NewSourceService(upstream, username, password string) *SourceService {
+	return &SourceService{
+		Upstream:          strings.TrimSuffix(upstream, "/"),
+		Username:          username,
+		Password:          password,
+		Client:            &http.Client{},
+		ReconnectInterval: 5 * time.Second,
+		mounts:            map[string]*relay{},
+		SourcetableTTL:    1 * time.Minute,
+	}
+}
+
+// GetSourcetable returns the upstream caster's sourcetable, fetching it at most once per
+// SourcetableTTL - if the upstream can't be reached the previously fetched sourcetable is returned
+func (ss *SourceService) GetSourcetable() ntrip.Sourcetable {
+	ss.sourcetableLock.Lock()
+	defer ss.sourcetableLock.Unlock()
+
+	if time.Now().Before(ss.sourcetableExpires) {
+		return ss.sourcetable
+	}
+
+	st, _, err := ntrip.GetSourcetable(context.Background(), ss.Upstream)
+	if err != nil {
+		return ss.sourcetable
+	}
+
+	ss.sourcetable = st
+	ss.sourcetableExpires = time.Now().Add(ss.SourcetableTTL)
+	return st
+}
+
+func (ss *SourceService) Publisher(ctx context.Context, mount, username, password string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("publishing is not supported by proxy")
+}
+
+func (ss *SourceService) Subscriber(ctx context.Context, mount, username, password string) (chan []byte, error) {
+	ss.Lock()
+	if r, ok := ss.mounts[mount]; ok {
+		defer ss.Unlock()
+		return ss.addSubscriber(ctx, mount, r), nil
+	}
+	ss.Unlock()
+
+	// Connect without holding the lock so a slow upstream doesn't block other mounts
+	relayCtx, cancel := context.WithCancel(context.Background())
+	body, err := ss.connect(relayCtx, mount)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	// Another subscriber may have connected to the upstream mount at the same time
+	if r, ok := ss.mounts[mount]; ok {
+		cancel()
+		body.Close()
+		return ss.addSubscriber(ctx, mount, r), nil
+	}
+
+	r := &relay{subscribers: map[chan []byte]struct{}{}, cancel: cancel}
+	ss.mounts[mount] = r
+	go ss.relay(relayCtx, mount, r, body)
+
+	return ss.addSubscriber(ctx, mount, r), nil
+}
+
+// Adds a subscriber to r which is removed when ctx is done, the upstream connection is closed once
+// r has no subscribers - must be called while holding the lock
+func (ss *SourceService) addSubscriber(ctx context.Context, mount string, r *relay) chan []byte {
+	data := make(chan []byte, subscriberBufferSize)
+	r.subscribers[data] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		ss.Lock()
+		defer ss.Unlock()
+
+		// May have already been removed by broadcast or removeRelay
+		if _, ok := r.subscribers[data]; !ok {
+			return
+		}
+
+		delete(r.subscribers, data)
+		close(data)
+		if len(r.subscribers) == 0 {
+			ss.removeRelay(mount, r)
+		}
+	}()
+
+	return data
+}
+
+// Connects to mount on the upstream caster, returning the response body
+func (ss *SourceService) connect(ctx context.Context, mount string) (io.ReadCloser, error) {
+	req, err := ntrip.NewClientRequest(ss.Upstream + "/" + mount)
+	if err != nil {
+		return nil, fmt.Errorf("error building upstream request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(ss.Username, ss.Password)
+
+	resp, err := ss.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to upstream: %s", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusUnauthorized:
+		resp.Body.Close()
+		return nil, ntrip.ErrorNotAuthorized
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ntrip.ErrorNotFound
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream responded with status %d", resp.StatusCode)
+	}
+}
+
+// Copies data from body to r's subscribers, reconnecting to the upstream mount when reading fails
+// until ctx is cancelled
+func (ss *SourceService) relay(ctx context.Context, mount string, r *relay, body io.ReadCloser) {
+	for {
+		for {
+			buf := make([]byte, 1024)
+			br, err := body.Read(buf)
+			if br > 0 {
+				ss.broadcast(mount, r, buf[:br])
+			}
+			if err != nil {
+				break
+			}
+		}
+		body.Close()
+
+		for body = nil; body == nil; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ss.ReconnectInterval):
+			}
+
+			var err error
+			body, err = ss.connect(ctx, mount)
+			if err == ntrip.ErrorNotFound || err == ntrip.ErrorNotAuthorized {
+				ss.Lock()
+				ss.removeRelay(mount, r)
+				ss.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// Writes data to each of r's subscribers, disconnecting those which aren't keeping up
+func (ss *SourceService) broadcast(mount string, r *relay, data []byte) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	for c := range r.subscribers {
+		select {
+		case c <- data:
+		default:
+			delete(r.subscribers, c)
+			close(c)
+		}
+	}
+
+	if len(r.subscribers) == 0 {
+		ss.removeRelay(mount, r)
+	}
+}
+
+// Closes the upstream connection and subscribers of r, removing it from the mounts map if it has
+// not already been replaced - must be called while holding the lock
+func (ss *SourceService) removeRelay(mount string, r *relay) {
+	if ss.mounts[mount] == r {
+		delete(ss.mounts, mount)
+	}
+
+	r.cancel()
+	for c := range r.subscribers {
+		close(c)
+	}
+	r.subscribers = map[chan []byte]struct{}{}
+}
@@ -0,0 +1,160 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/ntrip"
+	"github.com/go-gnss/ntrip/internal/inmemory"
+	"github.com/go-gnss/ntrip/internal/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+type allowAll struct{}
+
+func (_ *allowAll) Authorise(action inmemory.Action, mount string, username string, password string) (authorised bool, err error) {
+	return true, nil
+}
+
+// Fails the test if data isn't read from c within a second
+func expectData(t *testing.T, c chan []byte, data string) {
+	t.Helper()
+	select {
+	case d, ok := <-c:
+		if !ok {
+			t.Fatalf("subscriber channel closed unexpectedly")
+		}
+		if string(d) != data {
+			t.Fatalf("expected data %q, received %q", data, d)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for data")
+	}
+}
+
+// Returns the number of subscribers connected to the upstream caster
+func upstreamSubscribers(t *testing.T, caster *ntrip.Caster) int {
+	t.Helper()
+	conns, err := caster.Registry.Connections()
+	if err != nil {
+		t.Fatalf("error listing upstream connections: %s", err)
+	}
+
+	count := 0
+	for _, conn := range conns {
+		if conn.Role == ntrip.RoleSubscriber {
+			count++
+		}
+	}
+	return count
+}
+
+func TestProxyFanOut(t *testing.T) {
+	upstream := inmemory.NewSourceService(&allowAll{})
+	caster := ntrip.NewCaster("N/A", upstream, logrus.StandardLogger())
+	ts := httptest.NewServer(caster.Handler)
+	defer ts.Close()
+
+	pub, err := upstream.Publisher(context.Background(), "TEST", "publisher", "password")
+	if err != nil {
+		t.Fatalf("error connecting publisher: %s", err)
+	}
+	defer pub.Close()
+
+	ps := proxy.NewSourceService(ts.URL, "proxy", "password")
+	ps.ReconnectInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub1, err := ps.Subscriber(ctx, "TEST", "", "")
+	if err != nil {
+		t.Fatalf("error connecting first subscriber: %s", err)
+	}
+	sub2, err := ps.Subscriber(ctx, "TEST", "", "")
+	if err != nil {
+		t.Fatalf("error connecting second subscriber: %s", err)
+	}
+
+	pub.Write([]byte("first"))
+	expectData(t, sub1, "first")
+	expectData(t, sub2, "first")
+
+	if n := upstreamSubscribers(t, caster); n != 1 {
+		t.Errorf("expected 1 upstream connection, received %d", n)
+	}
+
+	// Drop the proxy's upstream connection, data is relayed again once the proxy reconnects
+	if err := upstream.DisconnectUser("proxy"); err != nil {
+		t.Fatalf("error disconnecting proxy: %s", err)
+	}
+
+	for start := time.Now(); upstreamSubscribers(t, caster) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("timeout waiting for proxy to reconnect")
+		}
+	}
+
+	// The upstream may still be registering the reconnected subscriber, so write until received
+	for start := time.Now(); ; {
+		pub.Write([]byte("second"))
+		select {
+		case d := <-sub1:
+			if string(d) != "second" {
+				t.Fatalf("expected data %q, received %q", "second", d)
+			}
+			expectData(t, sub2, "second")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		if time.Since(start) > time.Second {
+			t.Fatalf("timeout waiting for data after reconnect")
+		}
+	}
+}
+
+func TestProxyUpstreamNotFound(t *testing.T) {
+	caster := ntrip.NewCaster("N/A", inmemory.NewSourceService(&allowAll{}), logrus.StandardLogger())
+	ts := httptest.NewServer(caster.Handler)
+	defer ts.Close()
+
+	ps := proxy.NewSourceService(ts.URL, "proxy", "password")
+	if _, err := ps.Subscriber(context.Background(), "TEST", "", ""); err != ntrip.ErrorNotFound {
+		t.Errorf("expected error %s, received %v", ntrip.ErrorNotFound, err)
+	}
+}
+
+func TestProxySourcetableCache(t *testing.T) {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		fmt.Fprint(w, "STR;TEST;;;;;;;;0;0;0;0;;;B;N;0;\r\nENDSOURCETABLE\r\n")
+	}))
+	defer ts.Close()
+
+	ps := proxy.NewSourceService(ts.URL, "proxy", "password")
+	ps.SourcetableTTL = 100 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		if st := ps.GetSourcetable(); len(st.Mounts) != 1 || st.Mounts[0].Name != "TEST" {
+			t.Fatalf("unexpected sourcetable: %+v", st)
+		}
+	}
+
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("expected 1 upstream request within TTL, received %d", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	ps.GetSourcetable()
+
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("expected 2 upstream requests after TTL expired, received %d", n)
+	}
+}
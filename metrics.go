@@ -0,0 +1,154 @@
+package ntrip
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus collectors for a Caster, each Caster has its own registry so
+// multiple Casters can run in the same process
+type metrics struct {
+	registry         *prometheus.Registry
+	publishers       prometheus.Gauge
+	subscribers      *prometheus.GaugeVec
+	bytesRelayed     *prometheus.CounterVec
+	connectionErrors *prometheus.CounterVec
+	publisherGaps    *prometheus.CounterVec
+
+	// mountConnections counts each mount's connected publishers and subscribers, a mount's series
+	// are deleted once it has none so mounts which come and go don't accumulate series
+	mountConnections map[string]int
+	mountLock        sync.Mutex
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry:         prometheus.NewRegistry(),
+		mountConnections: map[string]int{},
+		// The _total suffix is usually reserved for counters, but this gauge keeps the name it
+		// was requested with so existing dashboards work
+		publishers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ntrip_publishers_total",
+			Help: "Number of connected publishers.",
+		}),
+		subscribers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ntrip_subscribers",
+			Help: "Number of connected subscribers by mount.",
+		}, []string{"mount"}),
+		bytesRelayed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntrip_bytes_relayed_total",
+			Help: "Bytes read from publishers (in) and written to subscribers (out) by mount.",
+		}, []string{"mount", "direction"}),
+		connectionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntrip_connection_errors_total",
+			Help: "Publisher and subscriber connections refused by reason.",
+		}, []string{"reason"}),
+		publisherGaps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ntrip_publisher_gaps_total",
+			Help: "Periods without data from a connected publisher longer than its gap timeout by mount.",
+		}, []string{"mount"}),
+	}
+	m.registry.MustRegister(m.publishers, m.subscribers, m.bytesRelayed, m.connectionErrors, m.publisherGaps)
+	return m
+}
+
+// MetricsHandler returns a http.Handler serving the Caster's metrics in the Prometheus exposition
+// format, this can be mounted on a separate admin server rather than on the Caster
+func (c *Caster) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(c.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// Tracks a connected publisher or subscriber, returning a function to call once it disconnects -
+// the mount's series must only be used between the two calls
+func (m *metrics) connected(mount string, role Role) func() {
+	m.mountLock.Lock()
+	defer m.mountLock.Unlock()
+
+	m.mountConnections[mount]++
+	gauge := m.publishers
+	if role == RoleSubscriber {
+		gauge = m.subscribers.WithLabelValues(mount)
+	}
+	gauge.Inc()
+
+	return func() {
+		m.mountLock.Lock()
+		defer m.mountLock.Unlock()
+
+		gauge.Dec()
+		if m.mountConnections[mount]--; m.mountConnections[mount] > 0 {
+			return
+		}
+
+		delete(m.mountConnections, mount)
+		m.subscribers.DeleteLabelValues(mount)
+		m.bytesRelayed.DeleteLabelValues(mount, "in")
+		m.bytesRelayed.DeleteLabelValues(mount, "out")
+		m.publisherGaps.DeleteLabelValues(mount)
+	}
+}
+
+// Counts a refused connection, using a label for the known SourceService errors so the reason
+// label has a bounded number of values
+func (m *metrics) refused(err error) {
+	reason := "error"
+	switch err {
+	case ErrorNotAuthorized:
+		reason = "not_authorized"
+	case ErrorNotFound:
+		reason = "not_found"
+	case ErrorConflict:
+		reason = "conflict"
+	case ErrorBadRequest:
+		reason = "bad_request"
+	case ErrorUnavailable:
+		reason = "unavailable"
+	case ErrorTooManyConnections:
+		reason = "too_many_connections"
+	}
+	m.connectionErrors.WithLabelValues(reason).Inc()
+}
+
+// Returns the counter of gaps in data from mount's publisher
+func (m *metrics) gaps(mount string) prometheus.Counter {
+	return m.publisherGaps.WithLabelValues(mount)
+}
+
+// Wraps r to count the bytes read from mount's publisher
+func (m *metrics) reader(r io.Reader, mount string) io.Reader {
+	return &metricsReader{r, m.bytesRelayed.WithLabelValues(mount, "in")}
+}
+
+// Wraps w to count the bytes written to a subscriber of mount
+func (m *metrics) writer(w io.Writer, mount string) io.Writer {
+	return &metricsWriter{w, m.bytesRelayed.WithLabelValues(mount, "out")}
+}
+
+// metricsReader counts the bytes read from a publisher as they're relayed, rather than once the
+// connection closes, because streams are commonly connected for days
+type metricsReader struct {
+	io.Reader
+	counter prometheus.Counter
+}
+
+func (mr *metricsReader) Read(p []byte) (int, error) {
+	n, err := mr.Reader.Read(p)
+	mr.counter.Add(float64(n))
+	return n, err
+}
+
+// metricsWriter is the io.Writer equivalent of metricsReader, for subscribers
+type metricsWriter struct {
+	io.Writer
+	counter prometheus.Counter
+}
+
+func (mw *metricsWriter) Write(p []byte) (int, error) {
+	n, err := mw.Writer.Write(p)
+	mw.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,111 @@
+package ntrip_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/ntrip/ntriptest"
+)
+
+// Polls the Caster's metrics until each of the expected lines is present, failing the test after
+// a second
+func expectMetrics(t *testing.T, handler http.Handler, lines ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		missing := ""
+		for _, line := range lines {
+			if !strings.Contains(rr.Body.String(), "\n"+line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("metric %q not found in:\n%s", missing, rr.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Polls the Caster's metrics until none of the lines start with the given prefixes, failing the
+// test after a second
+func expectMetricsRemoved(t *testing.T, handler http.Handler, prefixes ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		found := ""
+		for _, prefix := range prefixes {
+			if strings.Contains(rr.Body.String(), "\n"+prefix) {
+				found = prefix
+				break
+			}
+		}
+		if found == "" {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("metric %q not removed from:\n%s", found, rr.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCasterMetrics(t *testing.T) {
+	server := ntriptest.NewServer()
+	defer server.Close()
+	metrics := server.Caster.MetricsHandler()
+
+	pub, err := server.Publish("TEST")
+	if err != nil {
+		t.Fatalf("error publishing: %s", err)
+	}
+	sub, err := server.Subscribe("TEST")
+	if err != nil {
+		t.Fatalf("error subscribing: %s", err)
+	}
+	if _, err := server.Subscribe("UNKNOWN"); err == nil {
+		t.Fatalf("expected error subscribing to unknown mount")
+	}
+
+	pub.Write([]byte("data"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(sub, buf); err != nil {
+		t.Fatalf("error reading data: %s", err)
+	}
+
+	expectMetrics(t, metrics,
+		"ntrip_publishers_total 1",
+		`ntrip_subscribers{mount="TEST"} 1`,
+		`ntrip_bytes_relayed_total{direction="in",mount="TEST"} 4`,
+		`ntrip_bytes_relayed_total{direction="out",mount="TEST"} 4`,
+		`ntrip_connection_errors_total{reason="not_found"} 1`,
+	)
+
+	// The publisher is still connected, so the mount's series are kept
+	sub.Close()
+	expectMetrics(t, metrics, `ntrip_subscribers{mount="TEST"} 0`)
+
+	pub.Close()
+	expectMetrics(t, metrics, "ntrip_publishers_total 0")
+	// The mount's series are removed once it has no connections
+	expectMetricsRemoved(t, metrics,
+		`ntrip_subscribers{mount="TEST"}`,
+		`ntrip_bytes_relayed_total{direction="in",mount="TEST"}`,
+		`ntrip_bytes_relayed_total{direction="out",mount="TEST"}`,
+	)
+}
@@ -0,0 +1,143 @@
+package ntrip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GGA is a parsed NMEA GGA sentence, which clients send to casters to report their position for
+// nearest base and VRS mounts
+type GGA struct {
+	// Time is the UTC time of day of the fix, as a duration since midnight
+	Time time.Duration
+	// Latitude and Longitude are in decimal degrees, negative for south and west
+	Latitude  float64
+	Longitude float64
+	// Quality is the fix quality indicator, 0 meaning no fix
+	Quality    int
+	Satellites int
+	HDOP       float64
+	// Altitude above mean sea level in meters
+	Altitude float64
+}
+
+// ParseGGA parses an NMEA GGA sentence such as
+// "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47", validating the checksum
+func ParseGGA(sentence string) (GGA, error) {
+	sentence = strings.TrimSpace(sentence)
+	if !strings.HasPrefix(sentence, "$") {
+		return GGA{}, fmt.Errorf("sentence does not start with $")
+	}
+
+	star := strings.LastIndex(sentence, "*")
+	if star == -1 || len(sentence)-star != 3 {
+		return GGA{}, fmt.Errorf("sentence does not end with a checksum")
+	}
+
+	checksum, err := strconv.ParseUint(sentence[star+1:], 16, 8)
+	if err != nil {
+		return GGA{}, fmt.Errorf("invalid checksum %q", sentence[star+1:])
+	}
+
+	body := sentence[1:star]
+	if calculated := nmeaChecksum(body); calculated != byte(checksum) {
+		return GGA{}, fmt.Errorf("checksum mismatch, expected %02X but calculated %02X", checksum, calculated)
+	}
+
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 || !strings.HasSuffix(fields[0], "GGA") {
+		return GGA{}, fmt.Errorf("not a GGA sentence: %q", fields[0])
+	}
+
+	if len(fields) < 15 {
+		return GGA{}, fmt.Errorf("expected 15 fields, received %d", len(fields))
+	}
+
+	gga := GGA{}
+	if gga.Time, err = parseNMEATime(fields[1]); err != nil {
+		return GGA{}, err
+	}
+	if gga.Latitude, err = parseNMEACoordinate(fields[2], fields[3], 2, "N", "S"); err != nil {
+		return GGA{}, fmt.Errorf("invalid latitude: %s", err)
+	}
+	if gga.Longitude, err = parseNMEACoordinate(fields[4], fields[5], 3, "E", "W"); err != nil {
+		return GGA{}, fmt.Errorf("invalid longitude: %s", err)
+	}
+	if gga.Quality, err = strconv.Atoi(fields[6]); err != nil {
+		return GGA{}, fmt.Errorf("invalid fix quality %q", fields[6])
+	}
+
+	// The remaining fields may be empty depending on the receiver
+	if fields[7] != "" {
+		if gga.Satellites, err = strconv.Atoi(fields[7]); err != nil {
+			return GGA{}, fmt.Errorf("invalid satellite count %q", fields[7])
+		}
+	}
+	if fields[8] != "" {
+		if gga.HDOP, err = strconv.ParseFloat(fields[8], 64); err != nil {
+			return GGA{}, fmt.Errorf("invalid HDOP %q", fields[8])
+		}
+	}
+	if fields[9] != "" {
+		if gga.Altitude, err = strconv.ParseFloat(fields[9], 64); err != nil {
+			return GGA{}, fmt.Errorf("invalid altitude %q", fields[9])
+		}
+	}
+
+	return gga, nil
+}
+
+// XOR of all bytes between the $ and * of an NMEA sentence
+func nmeaChecksum(body string) byte {
+	var checksum byte
+	for i := 0; i < len(body); i++ {
+		checksum ^= body[i]
+	}
+	return checksum
+}
+
+// Parses hhmmss(.ss) into a duration since midnight
+func parseNMEATime(field string) (time.Duration, error) {
+	if len(field) < 6 {
+		return 0, fmt.Errorf("invalid time %q", field)
+	}
+
+	hours, herr := strconv.Atoi(field[0:2])
+	minutes, merr := strconv.Atoi(field[2:4])
+	seconds, serr := strconv.ParseFloat(field[4:], 64)
+	if herr != nil || merr != nil || serr != nil || hours > 23 || minutes > 59 || seconds >= 61 {
+		return 0, fmt.Errorf("invalid time %q", field)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)), nil
+}
+
+// Parses a (d)ddmm.mmmm coordinate with a hemisphere into decimal degrees
+func parseNMEACoordinate(value, hemisphere string, degreeDigits int, positive, negative string) (float64, error) {
+	if len(value) < degreeDigits+2 {
+		return 0, fmt.Errorf("%q is too short", value)
+	}
+
+	degrees, err := strconv.Atoi(value[:degreeDigits])
+	if err != nil {
+		return 0, fmt.Errorf("invalid degrees in %q", value)
+	}
+
+	minutes, err := strconv.ParseFloat(value[degreeDigits:], 64)
+	if err != nil || minutes >= 60 {
+		return 0, fmt.Errorf("invalid minutes in %q", value)
+	}
+
+	coordinate := float64(degrees) + minutes/60
+	switch hemisphere {
+	case positive:
+		return coordinate, nil
+	case negative:
+		return -coordinate, nil
+	default:
+		return 0, fmt.Errorf("invalid hemisphere %q", hemisphere)
+	}
+}
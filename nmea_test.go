@@ -0,0 +1,82 @@
+package ntrip_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/ntrip"
+)
+
+func TestParseGGA(t *testing.T) {
+	cases := []struct {
+		TestName string
+		Sentence string
+		GGA      ntrip.GGA
+	}{
+		{"North East", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\r\n", ntrip.GGA{
+			Time:       12*time.Hour + 35*time.Minute + 19*time.Second,
+			Latitude:   48.1173,
+			Longitude:  11.516666,
+			Quality:    1,
+			Satellites: 8,
+			HDOP:       0.9,
+			Altitude:   545.4,
+		}},
+		{"South West", "$GNGGA,012345.50,3512.3456,S,14907.8910,W,4,12,0.7,-10.5,M,12.0,M,1.0,0000*47", ntrip.GGA{
+			Time:       1*time.Hour + 23*time.Minute + 45500*time.Millisecond,
+			Latitude:   -35.205760,
+			Longitude:  -149.131516,
+			Quality:    4,
+			Satellites: 12,
+			HDOP:       0.7,
+			Altitude:   -10.5,
+		}},
+	}
+
+	for _, tc := range cases {
+		gga, err := ntrip.ParseGGA(tc.Sentence)
+		if err != nil {
+			t.Errorf("error in %s: %s", tc.TestName, err)
+			continue
+		}
+
+		if gga.Time != tc.GGA.Time || gga.Quality != tc.GGA.Quality || gga.Satellites != tc.GGA.Satellites {
+			t.Errorf("error in %s: expected %+v, received %+v", tc.TestName, tc.GGA, gga)
+		}
+
+		for _, f := range [][2]float64{
+			{gga.Latitude, tc.GGA.Latitude},
+			{gga.Longitude, tc.GGA.Longitude},
+			{gga.HDOP, tc.GGA.HDOP},
+			{gga.Altitude, tc.GGA.Altitude},
+		} {
+			if math.Abs(f[0]-f[1]) > 0.000001 {
+				t.Errorf("error in %s: expected %+v, received %+v", tc.TestName, tc.GGA, gga)
+			}
+		}
+	}
+}
+
+func TestParseGGAInvalid(t *testing.T) {
+	cases := []struct {
+		TestName string
+		Sentence string
+	}{
+		{"Bad Checksum", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*48"},
+		{"Non-Hex Checksum", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*ZZ"},
+		{"Missing Checksum", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,"},
+		{"Missing Dollar", "GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47"},
+		{"Truncated", "$GPGGA,123519,4807.038,N,01131.000,E,1,08*77"},
+		{"Truncated Checksum", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*4"},
+		{"No Fix", "$GPGGA,123519,,,,,0,,,,,,,,*6B"},
+		{"Not GGA", "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"},
+		{"Empty", ""},
+	}
+
+	for _, tc := range cases {
+		if _, err := ntrip.ParseGGA(tc.Sentence); err == nil {
+			t.Errorf("error in %s: expected error parsing %q", tc.TestName, tc.Sentence)
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package ntrip
 
 import (
+	"context"
 	"fmt"
 )
 
 const (
 	NTRIPVersionHeaderKey     string = "Ntrip-Version"
 	NTRIPVersionHeaderValueV2 string = "Ntrip/2.0"
+	// NTRIPGGAHeaderKey is the header NTRIP v2 clients can use to send their position as a GGA
+	// sentence when connecting, rather than after the response
+	NTRIPGGAHeaderKey string = "Ntrip-GGA"
 )
 
 // It's expected that SourceService implementations will use these errors to signal specific
@@ -17,10 +21,19 @@ var (
 	ErrorNotFound      error = fmt.Errorf("mount not found")
 	ErrorConflict      error = fmt.Errorf("mount in use")
 	ErrorBadRequest    error = fmt.Errorf("bad request")
+	// ErrorUnavailable signals that a mount exists but can't currently be subscribed to, for
+	// example because it's under maintenance - clients are asked to retry later
+	ErrorUnavailable error = fmt.Errorf("mount unavailable")
+	// ErrorTooManyConnections signals that the user already has as many connections as they're
+	// allowed
+	ErrorTooManyConnections error = fmt.Errorf("too many connections")
 
 	// TODO: Added this so a SourceService implementation can extract the Request ID, not sure that
 	//  smuggling it in the context is the best approach
 	RequestIDContextKey contextKey = contextKey("RequestID")
+	// RemoteAddrContextKey holds the address of the client which made the request, as given by
+	// http.Request.RemoteAddr
+	RemoteAddrContextKey contextKey = contextKey("RemoteAddr")
 )
 
 type contextKey string
@@ -28,3 +41,18 @@ type contextKey string
 func (c contextKey) String() string {
 	return string(c)
 }
+
+// RequestID returns the ID the Caster generated for the request ctx belongs to, which is included
+// in the Caster's log fields as request_id - SourceService implementations can use this to
+// correlate their logs with the Caster's, an empty string is returned if ctx has no request ID
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDContextKey).(string)
+	return id
+}
+
+// RemoteAddr returns the network address of the client which made the request ctx belongs to, an
+// empty string is returned if ctx has no remote address
+func RemoteAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(RemoteAddrContextKey).(string)
+	return addr
+}
@@ -0,0 +1,99 @@
+// Package ntriptest provides an in-process NTRIP caster for tests, similar to net/http/httptest
+package ntriptest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/go-gnss/ntrip"
+	"github.com/go-gnss/ntrip/internal/inmemory"
+	"github.com/sirupsen/logrus"
+)
+
+// Server is a Caster backed by an in-memory SourceService which accepts any credentials, listening
+// on a local loopback address
+type Server struct {
+	*httptest.Server
+	Caster *ntrip.Caster
+}
+
+type allowAll struct{}
+
+func (_ allowAll) Authorise(action inmemory.Action, mount, username, password string) (bool, error) {
+	return true, nil
+}
+
+// NewServer starts and returns a new Server, the caller should call Close when finished
+func NewServer() *Server {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	caster := ntrip.NewCaster("N/A", inmemory.NewSourceService(allowAll{}), logger)
+	server := httptest.NewUnstartedServer(caster.Handler)
+	// Caster's ConnContext is required for SubscriberWriteTimeout
+	server.Config.ConnContext = caster.ConnContext
+	server.Start()
+	return &Server{
+		Server: server,
+		Caster: caster,
+	}
+}
+
+// Publish connects an NTRIP v2 server to mount, data written to the returned WriteCloser is sent
+// to the caster until it's closed
+func (s *Server) Publish(mount string) (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	req, err := ntrip.NewServerRequest(s.URL+"/"+mount, r)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("ntriptest", "ntriptest")
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("received status code %d publishing to %s", resp.StatusCode, mount)
+	}
+
+	return &publisher{PipeWriter: w, resp: resp}, nil
+}
+
+// publisher closes the response as well as the request body when closed
+type publisher struct {
+	*io.PipeWriter
+	resp *http.Response
+}
+
+func (p *publisher) Close() error {
+	p.PipeWriter.Close()
+	return p.resp.Body.Close()
+}
+
+// Subscribe connects an NTRIP v2 client to mount, which must have a publisher connected - data
+// published to the mount can be read from the returned ReadCloser
+func (s *Server) Subscribe(mount string) (io.ReadCloser, error) {
+	req, err := ntrip.NewClientRequest(s.URL + "/" + mount)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("ntriptest", "ntriptest")
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("received status code %d subscribing to %s", resp.StatusCode, mount)
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,52 @@
+package ntriptest_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/go-gnss/ntrip/ntriptest"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	s := ntriptest.NewServer()
+	defer s.Close()
+
+	pub, err := s.Publish("MOUNT")
+	if err != nil {
+		t.Fatalf("error publishing: %s", err)
+	}
+	defer pub.Close()
+
+	subs := []io.ReadCloser{}
+	for i := 0; i < 2; i++ {
+		sub, err := s.Subscribe("MOUNT")
+		if err != nil {
+			t.Fatalf("error subscribing: %s", err)
+		}
+		defer sub.Close()
+		subs = append(subs, sub)
+	}
+
+	if _, err := pub.Write([]byte("some data")); err != nil {
+		t.Fatalf("error writing data: %s", err)
+	}
+
+	for _, sub := range subs {
+		buf := make([]byte, len("some data"))
+		if _, err := io.ReadFull(sub, buf); err != nil {
+			t.Fatalf("error reading data: %s", err)
+		}
+		if string(buf) != "some data" {
+			t.Errorf("expected %q, received %q", "some data", buf)
+		}
+	}
+}
+
+func TestSubscribeNotFound(t *testing.T) {
+	s := ntriptest.NewServer()
+	defer s.Close()
+
+	if _, err := s.Subscribe("MOUNT"); err == nil {
+		t.Errorf("expected error subscribing to mount without publisher")
+	}
+}
@@ -0,0 +1,242 @@
+// Package otelntrip adds OpenTelemetry tracing to an ntrip.Caster, it's a separate module so the
+// ntrip package doesn't depend on OpenTelemetry unless tracing is used
+//
+//	caster := ntrip.NewCaster(":2101", otelntrip.SourceService(svc, tp), logger)
+//	caster.Handler = otelntrip.Handler(caster.Handler, tp)
+package otelntrip
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-gnss/ntrip"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/go-gnss/ntrip/otelntrip"
+
+// Attributes set on the spans created by Handler and SourceService
+const (
+	MountKey        = attribute.Key("ntrip.mount")
+	VersionKey      = attribute.Key("ntrip.version")
+	BytesReadKey    = attribute.Key("ntrip.bytes_read")
+	BytesWrittenKey = attribute.Key("ntrip.bytes_written")
+	StatusCodeKey   = attribute.Key("http.response.status_code")
+)
+
+// Handler wraps a Caster's Handler, starting a span for each connection which ends once it's
+// closed - named ntrip.publish, ntrip.subscribe or ntrip.sourcetable, with the mount, NTRIP
+// version and bytes transferred as attributes
+func Handler(h http.Handler, tp trace.TracerProvider) http.Handler {
+	tracer := tp.Tracer(instrumentationName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mount := strings.Trim(r.URL.Path, "/")
+		version := 1
+		if strings.EqualFold(r.Header.Get(ntrip.NTRIPVersionHeaderKey), ntrip.NTRIPVersionHeaderValueV2) {
+			version = 2
+		}
+
+		ctx, span := tracer.Start(r.Context(), spanName(r.Method, mount),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(MountKey.String(mount), VersionKey.Int(version)))
+		defer span.End()
+
+		rw := &responseWriter{ResponseWriter: w}
+		body := &countingReader{Reader: r.Body}
+		r = r.WithContext(ctx)
+		// The Caster checks for http.NoBody to tell whether the client is streaming a body
+		if r.Body != http.NoBody {
+			r.Body = body
+		}
+
+		h.ServeHTTP(rw, r)
+
+		span.SetAttributes(
+			BytesReadKey.Int64(body.Count()),
+			BytesWrittenKey.Int64(rw.Count()),
+		)
+		// Hijacked NTRIP v1 connections don't use WriteHeader, so have no status code
+		if rw.status != 0 {
+			span.SetAttributes(StatusCodeKey.Int(rw.status))
+			if rw.status >= http.StatusBadRequest {
+				span.SetStatus(codes.Error, http.StatusText(rw.status))
+			}
+		}
+	})
+}
+
+func spanName(method, mount string) string {
+	switch {
+	case mount == "":
+		return "ntrip.sourcetable"
+	case method == http.MethodPost:
+		return "ntrip.publish"
+	default:
+		return "ntrip.subscribe"
+	}
+}
+
+// SourceService wraps svc, starting a child of the connection's span for each call to Publisher
+// and Subscriber - which is where SourceServices authorise requests. The returned SourceService
+// implements ntrip.GGASubscriber if svc does.
+func SourceService(svc ntrip.SourceService, tp trace.TracerProvider) ntrip.SourceService {
+	s := &sourceService{svc, tp.Tracer(instrumentationName)}
+	if gs, ok := svc.(ntrip.GGASubscriber); ok {
+		return &ggaSourceService{s, gs}
+	}
+	return s
+}
+
+type sourceService struct {
+	ntrip.SourceService
+	tracer trace.Tracer
+}
+
+func (s *sourceService) Publisher(ctx context.Context, mount, username, password string) (io.WriteCloser, error) {
+	ctx, span := s.start(ctx, "ntrip.Publisher", mount)
+	defer span.End()
+
+	pub, err := s.SourceService.Publisher(ctx, mount, username, password)
+	recordError(span, err)
+	return pub, err
+}
+
+func (s *sourceService) Subscriber(ctx context.Context, mount, username, password string) (chan []byte, error) {
+	ctx, span := s.start(ctx, "ntrip.Subscriber", mount)
+	defer span.End()
+
+	sub, err := s.SourceService.Subscriber(ctx, mount, username, password)
+	recordError(span, err)
+	return sub, err
+}
+
+func (s *sourceService) start(ctx context.Context, name, mount string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(MountKey.String(mount)))
+}
+
+type ggaSourceService struct {
+	*sourceService
+	gs ntrip.GGASubscriber
+}
+
+func (s *ggaSourceService) SubscriberWithGGA(ctx context.Context, mount, username, password string, gga <-chan ntrip.GGA) (chan []byte, error) {
+	ctx, span := s.start(ctx, "ntrip.Subscriber", mount)
+	defer span.End()
+
+	sub, err := s.gs.SubscriberWithGGA(ctx, mount, username, password, gga)
+	recordError(span, err)
+	return sub, err
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// responseWriter counts the bytes written to a client, including those written to hijacked NTRIP
+// v1 connections - it implements http.Flusher and http.Hijacker because the Caster needs them
+type responseWriter struct {
+	http.ResponseWriter
+	count  int64
+	status int
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	atomic.AddInt64(&rw.count, int64(n))
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not implement http.Hijacker")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Data written to brw is buffered again by the hijacked connection's writer, so it's flushed
+	// after each write to keep the Caster's flushes effective
+	w := bufio.NewWriter(&hijackedWriter{brw.Writer, &rw.count})
+	return conn, bufio.NewReadWriter(brw.Reader, w), nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Count returns the number of bytes written so far
+func (rw *responseWriter) Count() int64 {
+	return atomic.LoadInt64(&rw.count)
+}
+
+type hijackedWriter struct {
+	w     *bufio.Writer
+	count *int64
+}
+
+func (hw *hijackedWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	atomic.AddInt64(hw.count, int64(n))
+	if err != nil {
+		return n, err
+	}
+	return n, hw.w.Flush()
+}
+
+// countingReader counts the bytes read from a publisher's request body
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	atomic.AddInt64(&cr.count, int64(n))
+	return n, err
+}
+
+func (cr *countingReader) Close() error {
+	if c, ok := cr.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Count returns the number of bytes read so far
+func (cr *countingReader) Count() int64 {
+	return atomic.LoadInt64(&cr.count)
+}
@@ -0,0 +1,170 @@
+package otelntrip_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-gnss/ntrip"
+	"github.com/go-gnss/ntrip/internal/mock"
+	"github.com/go-gnss/ntrip/otelntrip"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Returns the value of key in span's attributes
+func attr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	caster := ntrip.NewCaster("N/A", otelntrip.SourceService(mock.NewMockSourceService(), tp), logger)
+	server := httptest.NewServer(otelntrip.Handler(caster.Handler, tp))
+	defer server.Close()
+
+	r, w := io.Pipe()
+	pubReq, _ := ntrip.NewServerRequest(server.URL+mock.MountPath, r)
+	pubReq.SetBasicAuth(mock.Username, mock.Password)
+	pubResp, err := server.Client().Do(pubReq)
+	if err != nil {
+		t.Fatalf("error publishing: %s", err)
+	}
+	defer pubResp.Body.Close()
+
+	subReq, _ := ntrip.NewClientRequest(server.URL + mock.MountPath)
+	subReq.SetBasicAuth(mock.Username, mock.Password)
+	subResp, err := server.Client().Do(subReq)
+	if err != nil {
+		t.Fatalf("error subscribing: %s", err)
+	}
+
+	w.Write([]byte("data"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(subResp.Body, buf); err != nil {
+		t.Fatalf("error reading data: %s", err)
+	}
+
+	// Ends both connections
+	w.Close()
+	ioutil.ReadAll(subResp.Body)
+	subResp.Body.Close()
+
+	unauthorisedReq, _ := ntrip.NewClientRequest(server.URL + mock.MountPath)
+	unauthorisedResp, err := server.Client().Do(unauthorisedReq)
+	if err != nil {
+		t.Fatalf("error making unauthorised request: %s", err)
+	}
+	unauthorisedResp.Body.Close()
+	server.Close()
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+
+	if len(spans["ntrip.publish"]) != 1 || len(spans["ntrip.Publisher"]) != 1 {
+		t.Fatalf("expected a publish span with a Publisher child, received %v", spans)
+	}
+	publish := spans["ntrip.publish"][0]
+	if spans["ntrip.Publisher"][0].Parent().SpanID() != publish.SpanContext().SpanID() {
+		t.Errorf("expected Publisher span to be a child of the publish span")
+	}
+	if attr(publish, otelntrip.MountKey).AsString() != mock.MountName || attr(publish, otelntrip.VersionKey).AsInt64() != 2 {
+		t.Errorf("unexpected publish span attributes: %v", publish.Attributes())
+	}
+	if read := attr(publish, otelntrip.BytesReadKey).AsInt64(); read != 4 {
+		t.Errorf("expected publish span to have read 4 bytes, received %d", read)
+	}
+
+	if len(spans["ntrip.subscribe"]) != 2 || len(spans["ntrip.Subscriber"]) != 2 {
+		t.Fatalf("expected two subscribe spans with Subscriber children, received %v", spans)
+	}
+	for i, subscribe := range spans["ntrip.subscribe"] {
+		subscriber := spans["ntrip.Subscriber"][i]
+		if subscriber.Parent().SpanID() != subscribe.SpanContext().SpanID() {
+			t.Errorf("expected Subscriber span to be a child of the subscribe span")
+		}
+
+		status := attr(subscribe, otelntrip.StatusCodeKey).AsInt64()
+		switch status {
+		case http.StatusOK:
+			if written := attr(subscribe, otelntrip.BytesWrittenKey).AsInt64(); written != 4 {
+				t.Errorf("expected subscribe span to have written 4 bytes, received %d", written)
+			}
+		case http.StatusUnauthorized:
+			if subscribe.Status().Code != codes.Error || subscriber.Status().Code != codes.Error {
+				t.Errorf("expected unauthorised spans to have error status")
+			}
+		default:
+			t.Errorf("unexpected subscribe span status code %d", status)
+		}
+	}
+}
+
+func TestTracingV1(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	ms := mock.NewMockSourceService()
+	ms.DataChannel = make(chan []byte, 1)
+	ms.DataChannel <- []byte("data")
+	caster := ntrip.NewCaster("N/A", otelntrip.SourceService(ms, tp), logger)
+	server := httptest.NewServer(otelntrip.Handler(caster.Handler, tp))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: caster\r\nAuthorization: Basic %s\r\n\r\n", mock.MountPath,
+		base64.StdEncoding.EncodeToString([]byte(mock.Username+":"+mock.Password)))
+
+	response := "ICY 200 OK\r\ndata"
+	buf := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != response {
+		t.Fatalf("expected response %q, received %q (%v)", response, buf, err)
+	}
+
+	// Ends the connection
+	close(ms.DataChannel)
+	ioutil.ReadAll(conn)
+	server.Close()
+
+	spans := recorder.Ended()
+	var subscribe sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == "ntrip.subscribe" {
+			subscribe = span
+		}
+	}
+	if subscribe == nil {
+		t.Fatalf("expected a subscribe span, received %v", spans)
+	}
+	if version := attr(subscribe, otelntrip.VersionKey).AsInt64(); version != 1 {
+		t.Errorf("expected version 1, received %d", version)
+	}
+	if written := attr(subscribe, otelntrip.BytesWrittenKey).AsInt64(); written != int64(len(response)) {
+		t.Errorf("expected subscribe span to have written %d bytes, received %d", len(response), written)
+	}
+}
@@ -0,0 +1,180 @@
+package ntrip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum length of a PROXY protocol v1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+// Signature which starts a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// NewProxyProtocolListener wraps l so connections from the trusted networks, such as a load
+// balancer in TCP mode, must start with a PROXY protocol v1 or v2 header - the connection's
+// RemoteAddr is the client address from the header. Connections from other addresses are not
+// parsed, so clients can't spoof their address. The header must be received within timeout,
+// zero disables the deadline.
+func NewProxyProtocolListener(l net.Listener, trusted []*net.IPNet, timeout time.Duration) net.Listener {
+	return &proxyListener{Listener: l, trusted: trusted, timeout: timeout}
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// Accept doesn't read the header, since that would block accepting other connections - it's read
+// on the first call to the connection's Read or RemoteAddr, which http.Server makes from the
+// connection's goroutine
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !pl.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReaderSize(conn, 512), timeout: pl.timeout}, nil
+}
+
+func (pl *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range pl.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection from a trusted proxy, reads fail if the PROXY header is invalid
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.once.Do(pc.readHeader)
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the proxy's address if the
+// header is invalid or doesn't contain an address (such as for the proxy's health checks)
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.once.Do(pc.readHeader)
+	if pc.remoteAddr != nil {
+		return pc.remoteAddr
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) readHeader() {
+	if pc.timeout > 0 {
+		pc.Conn.SetReadDeadline(time.Now().Add(pc.timeout))
+		defer pc.Conn.SetReadDeadline(time.Time{})
+	}
+
+	signature, err := pc.reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(signature, proxyV2Signature) {
+		pc.remoteAddr, pc.err = readProxyV2(pc.reader)
+	} else {
+		pc.remoteAddr, pc.err = readProxyV1(pc.reader)
+	}
+}
+
+// Reads a header such as "PROXY TCP4 192.0.2.1 192.0.2.2 54321 2101\r\n", returning nil for
+// UNKNOWN connections
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("error reading PROXY header: %s", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	header := string(line)
+	if !strings.HasSuffix(header, "\r\n") {
+		return nil, fmt.Errorf("invalid PROXY header %q", header)
+	}
+
+	fields := strings.Fields(header)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid PROXY header %q", header)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY header %q", header)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY header source address %q", header)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Reads a binary header, returning nil for LOCAL connections and address families other than
+// TCP over IPv4 or IPv6
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %s", err)
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY header version %d", header[12]>>4)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header addresses: %s", err)
+	}
+
+	// LOCAL command
+	if header[12]&0xF == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(addresses) < 12 {
+			return nil, fmt.Errorf("PROXY header too short for IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addresses) < 36 {
+			return nil, fmt.Errorf("PROXY header too short for IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	}
+	return nil, nil
+}
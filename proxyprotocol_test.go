@@ -0,0 +1,102 @@
+package ntrip_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/ntrip"
+)
+
+// Serves the request's RemoteAddr from a listener expecting PROXY headers from trusted, returning
+// the listener's address
+func serveRemoteAddr(t *testing.T, trusted string) string {
+	t.Helper()
+	_, network, err := net.ParseCIDR(trusted)
+	if err != nil {
+		t.Fatalf("invalid trusted network: %s", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go server.Serve(ntrip.NewProxyProtocolListener(l, []*net.IPNet{network}, time.Second))
+	t.Cleanup(func() { server.Close() })
+
+	return l.Addr().String()
+}
+
+// Sends header followed by a request to addr, returning the response body if successful
+func requestWithHeader(addr string, header []byte) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.Write(header)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: caster\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("received status code %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	v2Header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0C, // PROXY command, TCP over IPv4, 12 bytes of addresses
+		192, 0, 2, 1, 192, 0, 2, 2, 0xD4, 0x31, 0x08, 0x35) // 192.0.2.1:54321 -> 192.0.2.2:2101
+
+	cases := []struct {
+		Name       string
+		Trusted    string
+		Header     []byte
+		RemoteAddr string
+		Error      bool
+	}{
+		{"V1", "127.0.0.0/8", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 54321 2101\r\n"), "192.0.2.1:54321", false},
+		{"V1IPv6", "127.0.0.0/8", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 54321 2101\r\n"), "[2001:db8::1]:54321", false},
+		{"V1Unknown", "127.0.0.0/8", []byte("PROXY UNKNOWN\r\n"), "127.0.0.1", false},
+		{"V2", "127.0.0.0/8", v2Header, "192.0.2.1:54321", false},
+		{"MissingHeader", "127.0.0.0/8", nil, "", true},
+		{"Untrusted", "192.0.2.0/24", nil, "127.0.0.1", false},
+		{"UntrustedHeader", "192.0.2.0/24", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 54321 2101\r\n"), "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			body, err := requestWithHeader(serveRemoteAddr(t, tc.Trusted), tc.Header)
+			if tc.Error {
+				if err == nil {
+					t.Errorf("expected request to fail, received remote address %q", body)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error making request: %s", err)
+			}
+
+			// The proxy's own port is ephemeral, so only compare its host
+			if host, _, _ := net.SplitHostPort(body); host != tc.RemoteAddr && body != tc.RemoteAddr {
+				t.Errorf("expected remote address %q, received %q", tc.RemoteAddr, body)
+			}
+		})
+	}
+}
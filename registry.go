@@ -0,0 +1,102 @@
+package ntrip
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Role of a client connected to a mount
+type Role string
+
+const (
+	RolePublisher  Role = "publisher"
+	RoleSubscriber Role = "subscriber"
+)
+
+// Connection describes a publisher or subscriber connected to a Caster
+type Connection struct {
+	// ID is the request ID generated by the Caster, which is also included in log fields
+	ID         string
+	Mount      string
+	Username   string
+	Role       Role
+	RemoteAddr string
+	Connected  time.Time
+}
+
+// ConnectionRegistry keeps track of the connections active on a Caster, which is used to provide
+// stats and lookups of who is connected to which mount
+//
+// The default MemoryRegistry only knows about a single Caster. When running multiple Casters
+// behind a load balancer, a registry backed by shared storage can be used instead so each Caster
+// sees all connections - for example, a Redis implementation could store each Connection in a
+// hash keyed by ID (with an expiry in case a Caster exits without deregistering) and return
+// the contents of the hash from Connections.
+type ConnectionRegistry interface {
+	Register(conn Connection) error
+	Deregister(id string) error
+	Connections() ([]Connection, error)
+}
+
+// MemoryRegistry is an in-memory ConnectionRegistry, used by default by NewCaster
+type MemoryRegistry struct {
+	sync.Mutex
+	connections map[string]Connection
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		connections: map[string]Connection{},
+	}
+}
+
+func (mr *MemoryRegistry) Register(conn Connection) error {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.connections[conn.ID] = conn
+	return nil
+}
+
+func (mr *MemoryRegistry) Deregister(id string) error {
+	mr.Lock()
+	defer mr.Unlock()
+	delete(mr.connections, id)
+	return nil
+}
+
+// Connections returns all registered connections, ordered by the time they connected
+func (mr *MemoryRegistry) Connections() ([]Connection, error) {
+	mr.Lock()
+	defer mr.Unlock()
+
+	conns := make([]Connection, 0, len(mr.connections))
+	for _, conn := range mr.connections {
+		conns = append(conns, conn)
+	}
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Connected.Before(conns[j].Connected)
+	})
+	return conns, nil
+}
+
+// SubscriberCounts aggregates the subscribers in conns by the CountryCode and Network of their
+// mount's entry in st, such as the result of a ConnectionRegistry's Connections - subscribers to
+// mounts which aren't in st are not counted
+func SubscriberCounts(conns []Connection, st Sourcetable) (byCountry, byNetwork map[string]int) {
+	byCountry, byNetwork = map[string]int{}, map[string]int{}
+	for _, conn := range conns {
+		if conn.Role != RoleSubscriber {
+			continue
+		}
+
+		mount, ok := st.Mount(conn.Mount)
+		if !ok {
+			continue
+		}
+		byCountry[mount.CountryCode]++
+		byNetwork[mount.Network]++
+	}
+	return byCountry, byNetwork
+}
@@ -0,0 +1,172 @@
+package ntrip_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/ntrip"
+	"github.com/go-gnss/ntrip/internal/mock"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	mr := ntrip.NewMemoryRegistry()
+	now := time.Now()
+
+	mr.Register(ntrip.Connection{ID: "second", Mount: "MOUNT", Role: ntrip.RoleSubscriber, Connected: now.Add(time.Second)})
+	mr.Register(ntrip.Connection{ID: "first", Mount: "MOUNT", Role: ntrip.RolePublisher, Connected: now})
+
+	conns, err := mr.Connections()
+	if err != nil {
+		t.Fatalf("error listing connections: %s", err)
+	}
+	if len(conns) != 2 || conns[0].ID != "first" || conns[1].ID != "second" {
+		t.Fatalf("expected connections [first second] in connect order, received %v", conns)
+	}
+
+	mr.Deregister("first")
+	conns, _ = mr.Connections()
+	if len(conns) != 1 || conns[0].ID != "second" {
+		t.Errorf("expected connections [second] after deregister, received %v", conns)
+	}
+}
+
+func TestMemoryRegistryConcurrent(t *testing.T) {
+	mr := ntrip.NewMemoryRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprint(i)
+			mr.Register(ntrip.Connection{ID: id})
+			mr.Connections()
+			if i%2 == 0 {
+				mr.Deregister(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if conns, _ := mr.Connections(); len(conns) != 50 {
+		t.Errorf("expected 50 connections, received %d", len(conns))
+	}
+}
+
+func TestCasterRegistersConnections(t *testing.T) {
+	caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), logger)
+
+	r, w := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, mock.MountPath, r)
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	req.SetBasicAuth(mock.Username, mock.Password)
+
+	done := make(chan bool)
+	go func() {
+		caster.Handler.ServeHTTP(httptest.NewRecorder(), req)
+		done <- true
+	}()
+
+	// Write blocks until the publisher is connected
+	w.Write([]byte("data"))
+
+	conns, _ := caster.Registry.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 registered connection, received %d", len(conns))
+	}
+	if conns[0].Mount != mock.MountName || conns[0].Username != mock.Username || conns[0].Role != ntrip.RolePublisher {
+		t.Errorf("registered connection did not match request: %+v", conns[0])
+	}
+
+	w.Close()
+	<-done
+
+	if conns, _ := caster.Registry.Connections(); len(conns) != 0 {
+		t.Errorf("expected connection to be deregistered, received %v", conns)
+	}
+}
+
+func TestCasterConnectionCallbacks(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		ms := mock.NewMockSourceService()
+		if method == http.MethodGet {
+			ms.DataChannel = make(chan []byte, 1)
+			close(ms.DataChannel)
+		}
+
+		var connected, disconnected []ntrip.Connection
+		caster := ntrip.NewCaster("N/A", ms, logger)
+		// Callbacks are called without a Registry
+		caster.Registry = nil
+		caster.OnConnect = func(conn ntrip.Connection) { connected = append(connected, conn) }
+		caster.OnDisconnect = func(conn ntrip.Connection) { disconnected = append(disconnected, conn) }
+
+		req, _ := http.NewRequest(method, mock.MountPath, strings.NewReader(""))
+		req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+		req.SetBasicAuth(mock.Username, mock.Password)
+		req.RemoteAddr = "192.0.2.1:1234"
+		caster.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		role := ntrip.RoleSubscriber
+		if method == http.MethodPost {
+			role = ntrip.RolePublisher
+		}
+
+		if len(connected) != 1 || len(disconnected) != 1 {
+			t.Fatalf("%s: expected 1 connect and 1 disconnect callback, received %d and %d", method, len(connected), len(disconnected))
+		}
+		conn := connected[0]
+		if conn.Mount != mock.MountName || conn.Username != mock.Username || conn.Role != role || conn.RemoteAddr != "192.0.2.1:1234" {
+			t.Errorf("%s: connection did not match request: %+v", method, conn)
+		}
+		if disconnected[0] != conn {
+			t.Errorf("%s: expected disconnect callback with %+v, received %+v", method, conn, disconnected[0])
+		}
+	}
+
+	// Rejected requests are not connections
+	called := false
+	caster := ntrip.NewCaster("N/A", mock.NewMockSourceService(), logger)
+	caster.OnConnect = func(conn ntrip.Connection) { called = true }
+	req, _ := http.NewRequest(http.MethodGet, mock.MountPath, strings.NewReader(""))
+	req.Header.Add(ntrip.NTRIPVersionHeaderKey, ntrip.NTRIPVersionHeaderValueV2)
+	caster.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if called {
+		t.Errorf("expected OnConnect not to be called for unauthorized request")
+	}
+}
+
+func TestSubscriberCounts(t *testing.T) {
+	st := ntrip.Sourcetable{Mounts: []ntrip.StreamEntry{
+		{Name: "SYD", CountryCode: "AUS", Network: "CORSnet"},
+		{Name: "MEL", CountryCode: "AUS", Network: "GPSnet"},
+		{Name: "BER", CountryCode: "DEU", Network: "SAPOS"},
+	}}
+
+	conns := []ntrip.Connection{
+		{ID: "1", Mount: "SYD", Role: ntrip.RoleSubscriber},
+		{ID: "2", Mount: "SYD", Role: ntrip.RoleSubscriber},
+		{ID: "3", Mount: "MEL", Role: ntrip.RoleSubscriber},
+		{ID: "4", Mount: "BER", Role: ntrip.RoleSubscriber},
+		// Publishers and mounts missing from the sourcetable aren't counted
+		{ID: "5", Mount: "SYD", Role: ntrip.RolePublisher},
+		{ID: "6", Mount: "UNLISTED", Role: ntrip.RoleSubscriber},
+	}
+
+	byCountry, byNetwork := ntrip.SubscriberCounts(conns, st)
+	expectedCountry := map[string]int{"AUS": 3, "DEU": 1}
+	expectedNetwork := map[string]int{"CORSnet": 2, "GPSnet": 1, "SAPOS": 1}
+	if fmt.Sprint(byCountry) != fmt.Sprint(expectedCountry) {
+		t.Errorf("expected counts by country %v, received %v", expectedCountry, byCountry)
+	}
+	if fmt.Sprint(byNetwork) != fmt.Sprint(expectedNetwork) {
+		t.Errorf("expected counts by network %v, received %v", expectedNetwork, byNetwork)
+	}
+}
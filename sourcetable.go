@@ -1,14 +1,19 @@
 package ntrip
 
 import (
+	"bufio"
 	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/charmap"
 )
 
 // Sourcetable for NTRIP Casters, returned at / as a way for users to discover available mounts
@@ -39,6 +44,257 @@ func (st Sourcetable) String() string {
 	return strings.Join(stStrs, "\r\n")
 }
 
+// Mount returns the first mount entry with the given name, ok is false if there isn't one
+func (st Sourcetable) Mount(name string) (entry StreamEntry, ok bool) {
+	for _, m := range st.Mounts {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return StreamEntry{}, false
+}
+
+// HasMount returns true if st has a mount entry with the given name
+func (st Sourcetable) HasMount(name string) bool {
+	_, ok := st.Mount(name)
+	return ok
+}
+
+// Sorted returns a copy of st with casters ordered by Host and Port, networks by Identifier and
+// mounts by Name, so String produces the same output regardless of the order entries were added
+func (st Sourcetable) Sorted() Sourcetable {
+	sorted := Sourcetable{
+		Casters:  append([]CasterEntry(nil), st.Casters...),
+		Networks: append([]NetworkEntry(nil), st.Networks...),
+		Mounts:   append([]StreamEntry(nil), st.Mounts...),
+	}
+
+	sort.SliceStable(sorted.Casters, func(i, j int) bool {
+		a, b := sorted.Casters[i], sorted.Casters[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Port < b.Port
+	})
+	sort.SliceStable(sorted.Networks, func(i, j int) bool {
+		return sorted.Networks[i].Identifier < sorted.Networks[j].Identifier
+	})
+	sort.SliceStable(sorted.Mounts, func(i, j int) bool {
+		return sorted.Mounts[i].Name < sorted.Mounts[j].Name
+	})
+
+	return sorted
+}
+
+// ConflictPolicy decides how Sourcetable.Merge handles duplicate entries
+type ConflictPolicy int
+
+const (
+	// KeepFirst keeps the first of the duplicate entries
+	KeepFirst ConflictPolicy = iota
+	// KeepLast replaces the first of the duplicate entries with the last, keeping its position
+	KeepLast
+	// ConflictError returns an empty Sourcetable if there are any duplicate entries
+	ConflictError
+)
+
+// Merge returns a Sourcetable with the entries of st followed by those of other, and an error
+// describing each duplicate entry which was resolved using policy - mounts are duplicates if they
+// have the same Name, casters the same Host and Port, and networks the same Identifier. When
+// aggregating several upstream casters, KeepLast gives "last wins" behaviour.
+func (st Sourcetable) Merge(other Sourcetable, policy ConflictPolicy) (Sourcetable, []error) {
+	merged := Sourcetable{}
+	var conflicts []error
+
+	casters := append(append([]CasterEntry{}, st.Casters...), other.Casters...)
+	keys := make([]string, len(casters))
+	for i, c := range casters {
+		keys[i] = fmt.Sprintf("%s:%d", c.Host, c.Port)
+	}
+	indices, errs := mergeIndices(keys, policy, "caster")
+	for _, i := range indices {
+		merged.Casters = append(merged.Casters, casters[i])
+	}
+	conflicts = append(conflicts, errs...)
+
+	networks := append(append([]NetworkEntry{}, st.Networks...), other.Networks...)
+	keys = make([]string, len(networks))
+	for i, n := range networks {
+		keys[i] = n.Identifier
+	}
+	indices, errs = mergeIndices(keys, policy, "network")
+	for _, i := range indices {
+		merged.Networks = append(merged.Networks, networks[i])
+	}
+	conflicts = append(conflicts, errs...)
+
+	mounts := append(append([]StreamEntry{}, st.Mounts...), other.Mounts...)
+	keys = make([]string, len(mounts))
+	for i, m := range mounts {
+		keys[i] = m.Name
+	}
+	indices, errs = mergeIndices(keys, policy, "mount")
+	for _, i := range indices {
+		merged.Mounts = append(merged.Mounts, mounts[i])
+	}
+	conflicts = append(conflicts, errs...)
+
+	if policy == ConflictError && len(conflicts) > 0 {
+		return Sourcetable{}, conflicts
+	}
+	return merged, conflicts
+}
+
+// Returns the indices of the entries to keep given each entry's key, in the order they first
+// appear, and an error for each duplicate key
+func mergeIndices(keys []string, policy ConflictPolicy, entryType string) ([]int, []error) {
+	indices := []int{}
+	conflicts := []error{}
+	positions := map[string]int{}
+
+	for i, key := range keys {
+		pos, ok := positions[key]
+		if !ok {
+			positions[key] = len(indices)
+			indices = append(indices, i)
+			continue
+		}
+
+		conflicts = append(conflicts, fmt.Errorf("duplicate %s %q", entryType, key))
+		if policy == KeepLast {
+			indices[pos] = i
+		}
+	}
+
+	return indices, conflicts
+}
+
+// Filter returns the entries of st matching an NTRIP v2 sourcetable filter, such as
+// "STR;;;RTCM 3.2;;;;;DEU" - the first field selects the entry type, and each following non-empty
+// field must match the field at the same position in the entry's String representation, ignoring
+// case. A field can be prefixed with "!" to negate the match, or with "<" or ">" to compare
+// numerically. Only entries of the selected type are returned, an empty filter returns st.
+func (st Sourcetable) Filter(filter string) (Sourcetable, error) {
+	if filter == "" {
+		return st, nil
+	}
+
+	fields := strings.Split(filter, ";")
+	conditions := make([]*filterCondition, len(fields)-1)
+	for i, field := range fields[1:] {
+		c, err := parseFilterCondition(field)
+		if err != nil {
+			return Sourcetable{}, err
+		}
+		conditions[i] = c
+	}
+
+	entryType := strings.ToUpper(fields[0])
+	names, ok := entryFieldNames[entryType]
+	if !ok {
+		return Sourcetable{}, fmt.Errorf("invalid filter entry type %q", fields[0])
+	}
+	if len(conditions) > len(names) {
+		return Sourcetable{}, fmt.Errorf("filter has %d fields, %s entries have %d", len(conditions), entryType, len(names))
+	}
+
+	filtered := Sourcetable{}
+	switch entryType {
+	case "CAS":
+		for _, c := range st.Casters {
+			if matchesFilter(c, names, conditions) {
+				filtered.Casters = append(filtered.Casters, c)
+			}
+		}
+	case "NET":
+		for _, n := range st.Networks {
+			if matchesFilter(n, names, conditions) {
+				filtered.Networks = append(filtered.Networks, n)
+			}
+		}
+	case "STR":
+		for _, m := range st.Mounts {
+			if matchesFilter(m, names, conditions) {
+				filtered.Mounts = append(filtered.Mounts, m)
+			}
+		}
+	}
+	return filtered, nil
+}
+
+// Names of each entry type's Fields in the order they appear in a sourcetable line, after the
+// entry type, which filter fields are matched against by position
+var entryFieldNames = map[string][]string{
+	"CAS": {
+		"Host", "Port", "Identifier", "Operator", "NMEA", "Country", "Latitude", "Longitude",
+		"FallbackHostAddress", "FallbackHostPort", "Misc",
+	},
+	"NET": {
+		"Identifier", "Operator", "Authentication", "Fee", "NetworkInfoURL", "StreamInfoURL",
+		"RegistrationAddress", "Misc",
+	},
+	"STR": {
+		"Name", "Identifier", "Format", "FormatDetails", "Carrier", "NavSystem", "Network",
+		"CountryCode", "Latitude", "Longitude", "NMEA", "Solution", "Generator", "Compression",
+		"Authentication", "Fee", "Bitrate", "Misc",
+	},
+}
+
+// filterCondition is a single field of a sourcetable filter
+type filterCondition struct {
+	value string
+	// op is '<' or '>' for numeric comparisons, otherwise 0
+	op     byte
+	number float64
+	negate bool
+}
+
+// Returns nil for an empty field, which matches any value
+func parseFilterCondition(field string) (*filterCondition, error) {
+	if field == "" {
+		return nil, nil
+	}
+
+	c := &filterCondition{value: field}
+	if strings.HasPrefix(c.value, "!") {
+		c.negate, c.value = true, c.value[1:]
+	}
+
+	if strings.HasPrefix(c.value, "<") || strings.HasPrefix(c.value, ">") {
+		number, err := strconv.ParseFloat(c.value[1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid numeric filter %q", field)
+		}
+		c.op, c.number = c.value[0], number
+	}
+	return c, nil
+}
+
+func (c *filterCondition) matches(value string) bool {
+	var match bool
+	switch c.op {
+	case '<', '>':
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		match = (c.op == '<' && number < c.number) || (c.op == '>' && number > c.number)
+	default:
+		match = strings.EqualFold(value, c.value)
+	}
+	return match != c.negate
+}
+
+func matchesFilter(entry interface{ Fields() map[string]string }, names []string, conditions []*filterCondition) bool {
+	fields := entry.Fields()
+	for i, c := range conditions {
+		if c != nil && !c.matches(fields[names[i]]) {
+			return false
+		}
+	}
+	return true
+}
+
 // CasterEntry for an NTRIP Sourcetable
 type CasterEntry struct {
 	Host                string
@@ -72,6 +328,23 @@ func (c CasterEntry) String() string {
 	}, ";")
 }
 
+// Fields returns the entry's fields keyed by struct field name, formatted as they are in String
+func (c CasterEntry) Fields() map[string]string {
+	return map[string]string{
+		"Host":                c.Host,
+		"Port":                strconv.FormatInt(int64(c.Port), 10),
+		"Identifier":          c.Identifier,
+		"Operator":            c.Operator,
+		"NMEA":                formatFlag(c.NMEA, "1", "0"),
+		"Country":             c.Country,
+		"Latitude":            formatCoordinate(c.Latitude),
+		"Longitude":           formatCoordinate(c.Longitude),
+		"FallbackHostAddress": c.FallbackHostAddress,
+		"FallbackHostPort":    strconv.FormatInt(int64(c.FallbackHostPort), 10),
+		"Misc":                c.Misc,
+	}
+}
+
 // NetworkEntry for an NTRIP Sourcetable
 type NetworkEntry struct {
 	Identifier string
@@ -97,6 +370,20 @@ func (n NetworkEntry) String() string {
 		n.RegistrationAddress, n.Misc}, ";")
 }
 
+// Fields returns the entry's fields keyed by struct field name, formatted as they are in String
+func (n NetworkEntry) Fields() map[string]string {
+	return map[string]string{
+		"Identifier":          n.Identifier,
+		"Operator":            n.Operator,
+		"Authentication":      n.Authentication,
+		"Fee":                 formatFlag(n.Fee, "Y", "N"),
+		"NetworkInfoURL":      n.NetworkInfoURL,
+		"StreamInfoURL":       n.StreamInfoURL,
+		"RegistrationAddress": n.RegistrationAddress,
+		"Misc":                n.Misc,
+	}
+}
+
 // StreamEntry for an NTRIP Sourcetable
 type StreamEntry struct {
 	Name          string
@@ -159,11 +446,161 @@ func (m StreamEntry) String() string {
 	// m.Authentication, fee, m.Bitrate, m.Misc)
 }
 
+// Fields returns the entry's fields keyed by struct field name, formatted as they are in String,
+// allowing fields to be looked up by name without reflection
+func (m StreamEntry) Fields() map[string]string {
+	return map[string]string{
+		"Name":           m.Name,
+		"Identifier":     m.Identifier,
+		"Format":         m.Format,
+		"FormatDetails":  m.FormatDetails,
+		"Carrier":        m.Carrier,
+		"NavSystem":      m.NavSystem,
+		"Network":        m.Network,
+		"CountryCode":    m.CountryCode,
+		"Latitude":       formatCoordinate(m.Latitude),
+		"Longitude":      formatCoordinate(m.Longitude),
+		"NMEA":           formatFlag(m.NMEA, "1", "0"),
+		"Solution":       formatFlag(m.Solution, "1", "0"),
+		"Generator":      m.Generator,
+		"Compression":    m.Compression,
+		"Authentication": m.Authentication,
+		"Fee":            formatFlag(m.Fee, "Y", "N"),
+		"Bitrate":        strconv.FormatInt(int64(m.Bitrate), 10),
+		"Misc":           m.Misc,
+	}
+}
+
+func formatFlag(b bool, t, f string) string {
+	if b {
+		return t
+	}
+	return f
+}
+
+func formatCoordinate(c float32) string {
+	return strconv.FormatFloat(float64(c), 'f', 4, 32)
+}
+
+// Validate checks the entries of st against the NTRIP sourcetable format, returning an error for
+// each invalid field - this can be run before serving a sourcetable, since String doesn't check
+// for values which would corrupt the output
+func (st Sourcetable) Validate() []error {
+	var errs []error
+	for _, c := range st.Casters {
+		for _, err := range c.Validate() {
+			errs = append(errs, errors.Wrapf(err, "caster %s:%d", c.Host, c.Port))
+		}
+	}
+	for _, n := range st.Networks {
+		for _, err := range n.Validate() {
+			errs = append(errs, errors.Wrapf(err, "network %s", n.Identifier))
+		}
+	}
+	for _, m := range st.Mounts {
+		for _, err := range m.Validate() {
+			errs = append(errs, errors.Wrapf(err, "mount %s", m.Name))
+		}
+	}
+	return errs
+}
+
+// Validate checks c's fields against the NTRIP sourcetable format
+func (c CasterEntry) Validate() []error {
+	errs := validateFields(c.Fields())
+	if c.Host == "" {
+		errs = append(errs, fmt.Errorf("host is empty"))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid port %d", c.Port))
+	}
+	if c.FallbackHostPort < 0 || c.FallbackHostPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid fallback host port %d", c.FallbackHostPort))
+	}
+	return append(errs, validatePosition(c.Latitude, c.Longitude)...)
+}
+
+// Validate checks n's fields against the NTRIP sourcetable format
+func (n NetworkEntry) Validate() []error {
+	errs := validateFields(n.Fields())
+	if n.Identifier == "" {
+		errs = append(errs, fmt.Errorf("identifier is empty"))
+	}
+	if err := validateAuthentication(n.Authentication); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Validate checks m's fields against the NTRIP sourcetable format
+func (m StreamEntry) Validate() []error {
+	errs := validateFields(m.Fields())
+	if m.Name == "" {
+		errs = append(errs, fmt.Errorf("name is empty"))
+	}
+	if m.Carrier != "0" && m.Carrier != "1" && m.Carrier != "2" {
+		errs = append(errs, fmt.Errorf("invalid carrier %q, must be 0, 1 or 2", m.Carrier))
+	}
+	if err := validateAuthentication(m.Authentication); err != nil {
+		errs = append(errs, err)
+	}
+	if m.Bitrate < 0 {
+		errs = append(errs, fmt.Errorf("invalid bitrate %d", m.Bitrate))
+	}
+	return append(errs, validatePosition(m.Latitude, m.Longitude)...)
+}
+
+// Returns an error for each field containing a separator or line break, which would corrupt the
+// entry's String representation - fields are checked in name order so errors are deterministic
+func validateFields(fields map[string]string) []error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if strings.ContainsAny(fields[name], ";\r\n") {
+			errs = append(errs, fmt.Errorf("%s contains a separator or line break: %q", name, fields[name]))
+		}
+	}
+	return errs
+}
+
+func validateAuthentication(auth string) error {
+	if auth != "N" && auth != "B" && auth != "D" {
+		return fmt.Errorf("invalid authentication %q, must be N, B or D", auth)
+	}
+	return nil
+}
+
+// Longitudes may be given either as -180 to 180 or 0 to 360 degrees
+func validatePosition(lat, lng float32) []error {
+	var errs []error
+	if lat < -90 || lat > 90 {
+		errs = append(errs, fmt.Errorf("invalid latitude %.4f", lat))
+	}
+	if lng < -180 || lng > 360 {
+		errs = append(errs, fmt.Errorf("invalid longitude %.4f", lng))
+	}
+	return errs
+}
+
+// The maximum size in bytes of a sourcetable response read by GetSourcetable, larger responses
+// return an error rather than being read into memory
+const maxSourcetableSize = 10 << 20
+
 // GetSourcetable fetches a source table from a specific caster.
 //
 // The funciton returns a list of errors which can be treated as warnings.
 // These warnings indicate that the caster is returning an improper rtcm3 format.
 func GetSourcetable(ctx context.Context, url string) (Sourcetable, []error, error) {
+	return getSourcetable(ctx, url, maxSourcetableSize)
+}
+
+// GetSourcetable with a configurable maximum response size, so the limit can be tested
+func getSourcetable(ctx context.Context, url string, maxSize int64) (Sourcetable, []error, error) {
 	warnings := []error{}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -182,39 +619,110 @@ func GetSourcetable(ctx context.Context, url string) (Sourcetable, []error, erro
 	}
 	defer res.Body.Close()
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return Sourcetable{}, warnings, err
-	}
-
 	if res.StatusCode != 200 {
 		return Sourcetable{}, warnings, fmt.Errorf("received a non 200 status code")
 	}
 
+	// Read one byte more than the limit to tell a response of exactly the limit from a larger one
+	body := &countingReader{Reader: io.LimitReader(res.Body, maxSize+1)}
+	decoded, err := decodeSourcetable(body, res.Header.Get("Content-Type"))
+	if err != nil {
+		return Sourcetable{}, warnings, err
+	}
+
 	// Swollowing the errors here is okay because the errors are more like warnings.
 	// All rows that could be parsed will be present in the source table.
-	table, warnings := ParseSourcetable(string(body[:]))
+	table, warnings := ParseSourcetableReader(decoded)
+
+	if body.Count() > maxSize {
+		return Sourcetable{}, warnings, fmt.Errorf("sourcetable exceeds maximum size of %d bytes", maxSize)
+	}
 	return table, warnings, nil
 }
 
-// ParseSourcetable parses a sourcetable from an ioreader into a ntrip style source table.
+// Wraps a sourcetable response body in a reader which decodes it to UTF-8 using the charset from
+// contentType, defaulting to UTF-8 - some casters send Windows-1252 encoded station names without
+// specifying a charset, so lines which aren't valid UTF-8 are also decoded as Windows-1252
+func decodeSourcetable(body io.Reader, contentType string) (io.Reader, error) {
+	charset := ""
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		charset = strings.ToLower(params["charset"])
+	}
+
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii":
+		return &windows1252FallbackReader{r: bufio.NewReader(body)}, nil
+	// ISO-8859-1 is treated as Windows-1252, as browsers do
+	case "windows-1252", "cp1252", "iso-8859-1", "latin1":
+		return charmap.Windows1252.NewDecoder().Reader(body), nil
+	case "iso-8859-15", "latin9":
+		return charmap.ISO8859_15.NewDecoder().Reader(body), nil
+	default:
+		return nil, fmt.Errorf("unsupported sourcetable charset %q", charset)
+	}
+}
+
+// windows1252FallbackReader reads lines from r unchanged if they're valid UTF-8, otherwise
+// decoding them as Windows-1252
+type windows1252FallbackReader struct {
+	r   *bufio.Reader
+	buf []byte
+	err error
+}
+
+func (w *windows1252FallbackReader) Read(p []byte) (int, error) {
+	for len(w.buf) == 0 {
+		if w.err != nil {
+			return 0, w.err
+		}
+
+		var line []byte
+		line, w.err = w.r.ReadBytes('\n')
+		if !utf8.Valid(line) {
+			// Every byte maps to a character in Windows-1252, so decoding can't fail
+			line, _ = charmap.Windows1252.NewDecoder().Bytes(line)
+		}
+		w.buf = line
+	}
+
+	n := copy(p, w.buf)
+	w.buf = w.buf[n:]
+	return n, nil
+}
+
+// ParseSourcetable parses a sourcetable from a string into a ntrip style source table.
 func ParseSourcetable(str string) (Sourcetable, []error) {
+	return ParseSourcetableReader(strings.NewReader(str))
+}
+
+// ParseSourcetableReader parses a sourcetable line by line from r, so the whole sourcetable
+// doesn't need to be held in memory - reading stops at ENDSOURCETABLE, and errors reading from r
+// are included in the returned errors.
+func ParseSourcetableReader(r io.Reader) (Sourcetable, []error) {
 	table := Sourcetable{}
 	var allErrors []error
 
-	lines := strings.Split(str, "\n")
-
-	for lineNo, rawLine := range lines {
-		line := strings.TrimSpace(rawLine)
+	scanner := bufio.NewScanner(r)
+	// Lines can be longer than the default 64KB limit, so allow up to the size of a whole table
+	scanner.Buffer(nil, maxSourcetableSize)
+	for lineNo := 0; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
 
 		if line == "" {
 			continue
 		}
 
-		if line == "ENDSOURCETABLE" {
+		// The end marker may be followed by status text, such as "ENDSOURCETABLE 200 OK"
+		if line == "ENDSOURCETABLE" || strings.HasPrefix(line, "ENDSOURCETABLE ") {
 			break
 		}
 
+		// Lines too short to hold an entry type, such as a stray "OK", are skipped with a warning
+		if len(line) < 3 {
+			allErrors = append(allErrors, fmt.Errorf("skipping line %v, too short for an entry: %q", lineNo, line))
+			continue
+		}
+
 		switch line[:3] {
 		case "CAS":
 			caster, errs := ParseCasterEntry(line)
@@ -244,6 +752,10 @@ func ParseSourcetable(str string) (Sourcetable, []error) {
 
 	}
 
+	if err := scanner.Err(); err != nil {
+		allErrors = append(allErrors, errors.Wrap(err, "reading sourcetable"))
+	}
+
 	return table, allErrors
 }
 
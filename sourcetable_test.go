@@ -1,9 +1,14 @@
 package ntrip
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/gobuffalo/httptest"
@@ -235,3 +240,268 @@ func TestGetSourcetable(t *testing.T) {
 	expected, _ := ParseSourcetable(table)
 	require.Equal(t, expected, mapping)
 }
+
+func TestGetSourcetableTooLarge(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		line := "STR;TEST;;;;;;;;0;0;0;0;;;B;N;0;\r\n"
+		for i := 0; i < 100; i++ {
+			fmt.Fprint(w, line)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	_, _, err := getSourcetable(context.Background(), server.URL, 1024)
+	require.EqualError(t, err, "sourcetable exceeds maximum size of 1024 bytes")
+}
+
+func TestSourcetableMerge(t *testing.T) {
+	first := Sourcetable{
+		Casters:  []CasterEntry{{Host: "host", Port: 2101, Identifier: "first"}},
+		Networks: []NetworkEntry{{Identifier: "NET", Operator: "first"}},
+		Mounts:   []StreamEntry{{Name: "MOUNT1", Identifier: "first"}, {Name: "MOUNT2", Identifier: "first"}},
+	}
+	second := Sourcetable{
+		Casters:  []CasterEntry{{Host: "host", Port: 2102, Identifier: "second"}},
+		Networks: []NetworkEntry{{Identifier: "NET", Operator: "second"}},
+		Mounts:   []StreamEntry{{Name: "MOUNT1", Identifier: "second"}, {Name: "MOUNT3", Identifier: "second"}},
+	}
+
+	merged, conflicts := first.Merge(second, KeepFirst)
+	require.Len(t, conflicts, 2)
+	require.Equal(t, Sourcetable{
+		Casters:  []CasterEntry{{Host: "host", Port: 2101, Identifier: "first"}, {Host: "host", Port: 2102, Identifier: "second"}},
+		Networks: []NetworkEntry{{Identifier: "NET", Operator: "first"}},
+		Mounts:   []StreamEntry{{Name: "MOUNT1", Identifier: "first"}, {Name: "MOUNT2", Identifier: "first"}, {Name: "MOUNT3", Identifier: "second"}},
+	}, merged)
+
+	merged, conflicts = first.Merge(second, KeepLast)
+	require.Len(t, conflicts, 2)
+	require.Equal(t, Sourcetable{
+		Casters:  []CasterEntry{{Host: "host", Port: 2101, Identifier: "first"}, {Host: "host", Port: 2102, Identifier: "second"}},
+		Networks: []NetworkEntry{{Identifier: "NET", Operator: "second"}},
+		Mounts:   []StreamEntry{{Name: "MOUNT1", Identifier: "second"}, {Name: "MOUNT2", Identifier: "first"}, {Name: "MOUNT3", Identifier: "second"}},
+	}, merged)
+
+	merged, conflicts = first.Merge(second, ConflictError)
+	require.EqualError(t, conflicts[0], `duplicate network "NET"`)
+	require.EqualError(t, conflicts[1], `duplicate mount "MOUNT1"`)
+	require.Equal(t, Sourcetable{}, merged)
+
+	merged, conflicts = first.Merge(Sourcetable{Mounts: []StreamEntry{{Name: "MOUNT3"}}}, ConflictError)
+	require.Len(t, conflicts, 0)
+	require.Len(t, merged.Mounts, 3)
+}
+
+func TestSourcetableSorted(t *testing.T) {
+	st := Sourcetable{
+		Casters:  []CasterEntry{{Host: "b", Port: 2101}, {Host: "a", Port: 2102}, {Host: "a", Port: 2101}},
+		Networks: []NetworkEntry{{Identifier: "NET2"}, {Identifier: "NET1"}},
+		Mounts:   []StreamEntry{{Name: "MOUNT2"}, {Name: "MOUNT3"}, {Name: "MOUNT1"}},
+	}
+
+	expected := Sourcetable{
+		Casters:  []CasterEntry{{Host: "a", Port: 2101}, {Host: "a", Port: 2102}, {Host: "b", Port: 2101}},
+		Networks: []NetworkEntry{{Identifier: "NET1"}, {Identifier: "NET2"}},
+		Mounts:   []StreamEntry{{Name: "MOUNT1"}, {Name: "MOUNT2"}, {Name: "MOUNT3"}},
+	}
+
+	require.Equal(t, expected.String(), st.Sorted().String())
+	// Default ordering is unchanged
+	require.Equal(t, "MOUNT2", st.Mounts[0].Name)
+}
+
+func TestParseSourcetableDecoratedEnd(t *testing.T) {
+	for _, end := range []string{"ENDSOURCETABLE", "ENDSOURCETABLE 200 OK", "ENDSOURCETABLE\t "} {
+		table := "STR;MOUNT1;;;;;;;;0;0;0;0;;;B;N;0;\r\n" + end + "\r\nSTR;MOUNT2;;;;;;;;0;0;0;0;;;B;N;0;\r\n"
+		st, errs := ParseSourcetable(table)
+		require.Len(t, errs, 0, "parsing table ending with %q", end)
+		require.Len(t, st.Mounts, 1, "parsing table ending with %q", end)
+		require.Equal(t, "MOUNT1", st.Mounts[0].Name)
+	}
+}
+
+func TestGetSourcetableWindows1252(t *testing.T) {
+	// "Zürich" in Windows-1252, where ü is 0xFC
+	line := []byte("STR;ZURICH;Z\xfcrich;;;;;;;0;0;0;0;;;B;N;0;\r\nENDSOURCETABLE\r\n")
+
+	for _, contentType := range []string{"text/plain; charset=windows-1252", "text/plain; charset=ISO-8859-1", "text/plain", ""} {
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write(line)
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(handler))
+		st, _, err := GetSourcetable(context.Background(), server.URL)
+		server.Close()
+
+		require.Nil(t, err, "getting sourcetable with content type %q", contentType)
+		require.Len(t, st.Mounts, 1)
+		require.Equal(t, "Zürich", st.Mounts[0].Identifier, "content type %q", contentType)
+	}
+}
+
+func TestDecodeSourcetableCharset(t *testing.T) {
+	r, err := decodeSourcetable(strings.NewReader("Zürich\nZ\xfcrich\n"), "text/plain; charset=utf-8")
+	require.Nil(t, err)
+	// Only lines which aren't valid UTF-8 are decoded as Windows-1252
+	str, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "Zürich\nZürich\n", string(str))
+
+	_, err = decodeSourcetable(strings.NewReader("data"), "text/plain; charset=ebcdic")
+	require.EqualError(t, err, `unsupported sourcetable charset "ebcdic"`)
+}
+
+func TestEntryFields(t *testing.T) {
+	entries := []interface {
+		Fields() map[string]string
+	}{sourcetable.Casters[0], sourcetable.Networks[0], sourcetable.Mounts[0]}
+
+	for _, entry := range entries {
+		fields := entry.Fields()
+		typ := reflect.TypeOf(entry)
+		require.Len(t, fields, typ.NumField(), "%s.Fields() doesn't match struct", typ.Name())
+		for i := 0; i < typ.NumField(); i++ {
+			_, ok := fields[typ.Field(i).Name]
+			require.True(t, ok, "%s.Fields() missing field %s", typ.Name(), typ.Field(i).Name)
+		}
+
+		// Filters match fields by their position in the entry's String representation
+		line := strings.Split(entry.(fmt.Stringer).String(), ";")
+		names := entryFieldNames[line[0]]
+		require.Len(t, names, len(line)-1, "%s field names don't match String", typ.Name())
+		for i, name := range names {
+			require.Equal(t, line[i+1], fields[name], "%s field %s out of order", typ.Name(), name)
+		}
+	}
+
+	fields := sourcetable.Mounts[0].Fields()
+	require.Equal(t, sourcetable.Mounts[0].Name, fields["Name"])
+	require.Equal(t, "1.0000", fields["Latitude"])
+	require.Equal(t, "N", fields["Fee"])
+}
+
+func TestParseSourcetableShortLine(t *testing.T) {
+	st, errs := ParseSourcetable(sourcetable.Mounts[0].String() + "\r\nOK\r\nENDSOURCETABLE\r\n")
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "too short")
+	require.Equal(t, []StreamEntry{sourcetable.Mounts[0]}, st.Mounts)
+}
+
+// Lines longer than bufio.Scanner's default limit are parsed
+func TestParseSourcetableLongLine(t *testing.T) {
+	long := sourcetable.Mounts[0]
+	long.Misc = strings.Repeat("x", 2*bufio.MaxScanTokenSize)
+	st, errs := ParseSourcetableReader(strings.NewReader(long.String() + "\r\n" + sourcetable.Mounts[1].String() + "\r\n"))
+	require.Len(t, errs, 0)
+	require.Equal(t, []StreamEntry{long, sourcetable.Mounts[1]}, st.Mounts)
+}
+
+// failingReader fails the test if it's read from
+type failingReader struct {
+	t *testing.T
+}
+
+func (f failingReader) Read(p []byte) (int, error) {
+	f.t.Errorf("read past end of sourcetable")
+	return 0, io.EOF
+}
+
+// errReader returns err from every Read
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
+func TestParseSourcetableReader(t *testing.T) {
+	// Reading stops at ENDSOURCETABLE, without waiting for the connection to close
+	r := io.MultiReader(strings.NewReader(sourcetable.String()), failingReader{t})
+	st, errs := ParseSourcetableReader(r)
+	require.Len(t, errs, 0)
+	require.Equal(t, sourcetable, st)
+
+	// Read errors are returned with parsing errors
+	r = io.MultiReader(strings.NewReader(sourcetable.Mounts[0].String()+"\r\n"), errReader{fmt.Errorf("connection reset")})
+	st, errs = ParseSourcetableReader(r)
+	require.Len(t, errs, 1)
+	require.EqualError(t, errs[0], "reading sourcetable: connection reset")
+	require.Equal(t, []StreamEntry{sourcetable.Mounts[0]}, st.Mounts)
+}
+
+func TestSourcetableFilter(t *testing.T) {
+	cases := []struct {
+		Filter   string
+		Expected Sourcetable
+		Error    string
+	}{
+		{"", sourcetable, ""},
+		{"STR;name2", Sourcetable{Mounts: sourcetable.Mounts[1:]}, ""},
+		{"str;NAME", Sourcetable{Mounts: sourcetable.Mounts[:1]}, ""},
+		{"STR;!name", Sourcetable{Mounts: sourcetable.Mounts[1:]}, ""},
+		{"STR;;;;;;;;;>1.5", Sourcetable{Mounts: sourcetable.Mounts[1:]}, ""},
+		{"STR;;;;;;;;DEU", Sourcetable{}, ""},
+		{"CAS;;2101", Sourcetable{Casters: sourcetable.Casters[:1]}, ""},
+		{"NET;identifier2", Sourcetable{Networks: sourcetable.Networks[1:]}, ""},
+		{"FOO;name", Sourcetable{}, `invalid filter entry type "FOO"`},
+		{"STR;;;;;;;;;<north", Sourcetable{}, `invalid numeric filter "<north"`},
+		{"NET" + strings.Repeat(";x", 9), Sourcetable{}, "filter has 9 fields, NET entries have 8"},
+	}
+
+	for _, tc := range cases {
+		filtered, err := sourcetable.Filter(tc.Filter)
+		if tc.Error != "" {
+			require.EqualError(t, err, tc.Error, "filter %q", tc.Filter)
+			continue
+		}
+		require.Nil(t, err, "filter %q", tc.Filter)
+		require.Equal(t, tc.Expected, filtered, "filter %q", tc.Filter)
+	}
+}
+
+func TestSourcetableMountLookup(t *testing.T) {
+	m, ok := sourcetable.Mount("name2")
+	require.True(t, ok)
+	require.Equal(t, sourcetable.Mounts[1], m)
+	require.True(t, sourcetable.HasMount("name"))
+
+	m, ok = sourcetable.Mount("missing")
+	require.False(t, ok)
+	require.Equal(t, StreamEntry{}, m)
+	require.False(t, sourcetable.HasMount("missing"))
+	require.False(t, Sourcetable{}.HasMount(""))
+}
+
+func TestSourcetableValidate(t *testing.T) {
+	valid := Sourcetable{
+		Casters:  []CasterEntry{{Host: "caster.example.com", Port: 2101, Latitude: -35.3, Longitude: 149.1}},
+		Networks: []NetworkEntry{{Identifier: "NET", Authentication: "B"}},
+		Mounts:   []StreamEntry{{Name: "MOUNT", Format: "RTCM 3.2", Carrier: "2", Authentication: "B", Longitude: 350}},
+	}
+	require.Len(t, valid.Validate(), 0)
+
+	invalid := Sourcetable{
+		Casters:  []CasterEntry{{Host: "caster.example.com", Port: 0}},
+		Networks: []NetworkEntry{{Identifier: "NET", Authentication: "X"}},
+		Mounts: []StreamEntry{
+			{Name: "MOUNT", Format: "RTCM;3.2", Carrier: "3", Authentication: "N", Latitude: 91, Bitrate: -1},
+		},
+	}
+	errs := invalid.Validate()
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	require.Equal(t, []string{
+		"caster caster.example.com:0: invalid port 0",
+		`network NET: invalid authentication "X", must be N, B or D`,
+		`mount MOUNT: Format contains a separator or line break: "RTCM;3.2"`,
+		`mount MOUNT: invalid carrier "3", must be 0, 1 or 2`,
+		"mount MOUNT: invalid bitrate -1",
+		"mount MOUNT: invalid latitude 91.0000",
+	}, messages)
+}